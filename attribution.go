@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/matthewbloch/text-guests/uplisting"
+)
+
+// How far past today we look for bookings guests have made since we texted
+// them.
+const attributionLookahead = time.Hour * 24 * 365
+
+// attributedSend is one text we sent and the bookings the guest made
+// because of it, or at least after it.
+type attributedSend struct {
+	send     sendRecord
+	bookings []uplisting.Booking
+}
+
+func (a attributedSend) direct() bool {
+	for _, booking := range a.bookings {
+		if booking.Channel == uplisting.ChannelUplisting {
+			return true
+		}
+	}
+	return false
+}
+
+/* attribute credits each booking to the latest text the same guest was sent
+ * before they made it, if that was within window. Guests are recognised the
+ * same way as in a normal run, so a guest who rebooks with a new phone number
+ * but the same email still counts.
+ */
+func attribute(sends []sendRecord, bookings []uplisting.Booking, window time.Duration, minConfidence float64) []attributedSend {
+	identities, _ := resolveIdentities(activeBookings(bookings), minConfidence)
+	byPhone := make(map[string]*identity)
+	byEmail := make(map[string]*identity)
+	for _, id := range identities {
+		for _, phone := range id.phones {
+			byPhone[phone] = id
+		}
+		for _, email := range id.emails {
+			if email = realEmail(email); email != "" {
+				byEmail[email] = id
+			}
+		}
+	}
+
+	attributed := make([]attributedSend, len(sends))
+	sendsByIdentity := make(map[*identity][]int)
+	for i, send := range sends {
+		attributed[i].send = send
+		id, ok := byPhone[send.Phone]
+		if !ok {
+			id, ok = byEmail[realEmail(send.Email)]
+		}
+		if ok {
+			sendsByIdentity[id] = append(sendsByIdentity[id], i)
+		}
+	}
+
+	for id, indexes := range sendsByIdentity {
+		for _, booking := range id.bookings {
+			bookedAt := booking.BookedAtTime()
+			latest := -1
+			for _, i := range indexes {
+				sentAt := sends[i].SentAt
+				if sentAt.After(bookedAt) || bookedAt.Sub(sentAt) > window {
+					continue
+				}
+				if latest < 0 || sentAt.After(sends[latest].SentAt) {
+					latest = i
+				}
+			}
+			if latest >= 0 {
+				attributed[latest].bookings = append(attributed[latest].bookings, booking)
+			}
+		}
+	}
+	return attributed
+}
+
+// attribution sums up how a group of texts did.
+type attribution struct {
+	sent, rebooked, direct int
+	revenue, directRevenue float64
+}
+
+func groupAttribution(attributed []attributedSend, key func(sendRecord) string) map[string]*attribution {
+	groups := make(map[string]*attribution)
+	for _, a := range attributed {
+		k := key(a.send)
+		group, ok := groups[k]
+		if !ok {
+			group = &attribution{}
+			groups[k] = group
+		}
+		group.sent++
+		if len(a.bookings) > 0 {
+			group.rebooked++
+		}
+		if a.direct() {
+			group.direct++
+		}
+		for _, booking := range a.bookings {
+			group.revenue += booking.TotalPayout
+			if booking.Channel == uplisting.ChannelUplisting {
+				group.directRevenue += booking.TotalPayout
+			}
+		}
+	}
+	return groups
+}
+
+func writeAttributionTable(w io.Writer, heading string, groups map[string]*attribution) error {
+	keys := make([]string, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "%s\tSENT\tREBOOKED\tDIRECT\tDIRECT RATE\tREVENUE\tDIRECT REVENUE\n", heading)
+	for _, key := range keys {
+		g := groups[key]
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%.1f%%\t%.2f\t%.2f\n",
+			key, g.sent, g.rebooked, g.direct, 100*float64(g.direct)/float64(g.sent), g.revenue, g.directRevenue)
+	}
+	return tw.Flush()
+}
+
+// writeAttribution shows how texts did by template, by variant if we've been
+// testing any, and by the property the guest had last stayed at when we
+// texted them.
+func writeAttribution(w io.Writer, attributed []attributedSend, window time.Duration) error {
+	if len(attributed) == 0 {
+		_, err := fmt.Fprintln(w, "No texts sent yet")
+		return err
+	}
+	fmt.Fprintf(w, "Bookings made within %.0f days of a text, credited to the latest text\n\n", window.Hours()/24)
+	byTemplate := groupAttribution(attributed, func(s sendRecord) string { return s.Template })
+	if err := writeAttributionTable(w, "TEMPLATE", byTemplate); err != nil {
+		return err
+	}
+	fmt.Fprintln(w)
+	if byVariant := groupAttribution(attributed, sendVariant); len(byVariant) > len(byTemplate) {
+		if err := writeAttributionTable(w, "VARIANT", byVariant); err != nil {
+			return err
+		}
+		fmt.Fprintln(w)
+	}
+	return writeAttributionTable(w, "PROPERTY", groupAttribution(attributed, func(s sendRecord) string { return s.Property }))
+}
+
+// sendVariant is the variant of the template we sent, which for texts sent
+// before we tested variants is just the template.
+func sendVariant(s sendRecord) string {
+	if s.Variant == "" {
+		return s.Template
+	}
+	return s.Variant
+}
+
+// attributionCommand reports on every text in our history.
+func attributionCommand(config config, uplistingClient *uplisting.Client) error {
+	store, err := openStore(config.StateFile)
+	if err != nil {
+		return err
+	}
+	sends := store.sends()
+	if len(sends) == 0 {
+		return writeAttribution(os.Stdout, nil, config.AttributionWindow)
+	}
+
+	from := sends[0].SentAt
+	for _, send := range sends {
+		if send.SentAt.Before(from) {
+			from = send.SentAt
+		}
+	}
+	properties, err := uplistingClient.GetProperties()
+	if err != nil {
+		return err
+	}
+	bookings := fetchBookings(uplistingClient, properties, from, time.Now().Add(attributionLookahead), config.UplistingWorkers, nil)
+	attributed := attribute(sends, bookings, config.AttributionWindow, config.IdentityMinConfidence)
+	return writeAttribution(os.Stdout, attributed, config.AttributionWindow)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matthewbloch/text-guests/uplisting"
+)
+
+func TestAttribute(t *testing.T) {
+	booked := func(b uplisting.Booking, bookedAt string) uplisting.Booking {
+		b.BookedAt = bookedAt + "T12:00:00Z"
+		return b
+	}
+	at := func(date string) time.Time {
+		tm, _ := time.Parse("2006-01-02", date)
+		return tm.Add(10 * time.Hour)
+	}
+	cancelled := booked(guestBooking(6, "Doris Rodríguez", "+447700900123", "doris@example.com"), "2023-11-11")
+	cancelled.Status = uplisting.StatusCancelled
+	bookings := []uplisting.Booking{
+		booked(guestBooking(1, "Doris Rodríguez", "+447700900123", "doris@example.com"), "2023-09-01"),
+		booked(guestBooking(2, "Doris Rodríguez", "+447700900123", "doris@example.com"), "2023-11-05"),
+		booked(stay(3, "2023-12-20", 3, 300, uplisting.ChannelUplisting), "2023-11-12"),
+		booked(guestBooking(4, "Ahmed Khan", "+447700900200", "ahmed@example.com"), "2023-10-20"),
+		booked(guestBooking(5, "Zoe Smith", "+447700900300", ""), "2024-03-15"),
+		cancelled,
+		booked(guestBooking(7, "Ivan Petrov", "+447700900500", "ivan.1@guest.booking.com"), "2023-11-20"),
+	}
+	bookings[3].TotalPayout, bookings[3].Channel = 150, uplisting.ChannelBookingDotCom
+
+	sends := []sendRecord{
+		{Phone: "+447700900123", Template: "RECENT", SentAt: at("2023-11-01")},
+		{Phone: "+447700900123", Template: "OLD", SentAt: at("2023-11-10")},
+		// Texted at a number Ahmed hasn't booked with, but the same email
+		{Phone: "+447700900201", Email: "Ahmed@example.com", Template: "RECENT", SentAt: at("2023-10-15")},
+		// Zoe took too long to book
+		{Phone: "+447700900300", Template: "OLD", SentAt: at("2024-01-01")},
+		// A relay address matches nobody
+		{Phone: "+447700900501", Email: "ivan.1@guest.booking.com", Template: "RECENT", SentAt: at("2023-11-15")},
+	}
+
+	attributed := attribute(sends, bookings, 30*24*time.Hour, 0.9)
+	want := [][]int{
+		{2}, // the later send gets the later booking
+		{3}, // and not the cancelled one
+		{4}, // found by email
+		nil, // outside the window
+		nil, // not found at all
+	}
+	for i, a := range attributed {
+		var ids []int
+		for _, b := range a.bookings {
+			ids = append(ids, b.ID)
+		}
+		if !reflect.DeepEqual(ids, want[i]) || a.send.SentAt != sends[i].SentAt {
+			t.Errorf("send %d credited with %v, want %v", i, ids, want[i])
+		}
+	}
+	if attributed[0].direct() || !attributed[1].direct() {
+		t.Error("direct bookings credited wrongly")
+	}
+
+	byTemplate := groupAttribution(attributed, func(s sendRecord) string { return s.Template })
+	wantGroups := map[string]*attribution{
+		"RECENT": {sent: 3, rebooked: 2, revenue: 350},
+		"OLD":    {sent: 2, rebooked: 1, direct: 1, revenue: 300, directRevenue: 300},
+	}
+	for template, want := range wantGroups {
+		if got := byTemplate[template]; got == nil || *got != *want {
+			t.Errorf("%s: got %+v, want %+v", template, got, want)
+		}
+	}
+}
+
+func TestWriteAttributionVariants(t *testing.T) {
+	sentAt := time.Date(2023, 11, 10, 10, 0, 0, 0, time.UTC)
+	send := func(template, variant string) attributedSend {
+		return attributedSend{send: sendRecord{Template: template, Variant: variant, Property: "Agar Street", SentAt: sentAt}}
+	}
+
+	tests := []struct {
+		name     string
+		sends    []attributedSend
+		variants []string
+	}{
+		{
+			name:  "before any variants",
+			sends: []attributedSend{send("RECENT", ""), send("OLD", "")},
+		},
+		{
+			name:  "only the base template",
+			sends: []attributedSend{send("RECENT", "RECENT"), send("OLD", "")},
+		},
+		{
+			// Texts from before the test count towards the base template
+			name:     "testing",
+			sends:    []attributedSend{send("RECENT", ""), send("RECENT", "RECENT"), send("RECENT", "RECENT_B"), send("OLD", "")},
+			variants: []string{"OLD       1", "RECENT    2", "RECENT_B  1"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := writeAttribution(&buf, test.sends, 30*24*time.Hour); err != nil {
+				t.Fatal(err)
+			}
+			out := buf.String()
+			if strings.Contains(out, "VARIANT") != (test.variants != nil) {
+				t.Fatalf("VARIANT table shown wrongly:\n%s", out)
+			}
+			_, table, _ := strings.Cut(out, "VARIANT")
+			table, _, _ = strings.Cut(table, "PROPERTY")
+			for _, row := range test.variants {
+				if !strings.Contains(table, "\n"+row) {
+					t.Errorf("no row %q in:\n%s", row, out)
+				}
+			}
+		})
+	}
+}
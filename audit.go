@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/matthewbloch/text-guests/textmagic"
+	"github.com/matthewbloch/text-guests/uplisting"
+)
+
+// auditContacts lists every TextMagic contact, and whether we can find an
+// Uplisting booking with the same phone number or real email address.
+func auditContacts(w io.Writer, client *textmagic.Client, bookings []uplisting.Booking, listId int) error {
+	byPhone := make(map[string]uplisting.Booking)
+	byEmail := make(map[string]uplisting.Booking)
+	for _, booking := range bookings {
+		byPhone[booking.GuestPhone] = booking
+		if email := realEmail(booking.GuestEmail); email != "" {
+			byEmail[email] = booking
+		}
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tPHONE\tEMAIL\tIN LIST\tMATCHED BY\tBOOKING")
+	var total, matched int
+	err := client.EachContact(func(contact textmagic.Contact) error {
+		total++
+		matchedBy, booking := "", uplisting.Booking{}
+		if b, ok := byPhone[normalizePhone(contact.Phone)]; ok {
+			matchedBy, booking = "phone", b
+		} else if b, ok := byEmail[realEmail(contact.Email)]; ok {
+			matchedBy, booking = "email", b
+		}
+		bookingDescription := "-"
+		if matchedBy != "" {
+			matched++
+			bookingDescription = fmt.Sprintf("%s %s", booking.PropertyName, booking.CheckIn)
+		} else {
+			matchedBy = "-"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%t\t%s\t%s\n",
+			contact.Id, strings.TrimSpace(contact.FirstName+" "+contact.LastName),
+			contact.Phone, contact.Email, inList(contact, listId), matchedBy, bookingDescription)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "\n%d contacts, %d matched to Uplisting bookings, %d not\n", total, matched, total-matched)
+	return nil
+}
+
+// auditContactsCommand takes an optional date, YYYY-MM-DD, to look for
+// bookings since. It defaults to the same window as a normal run.
+func auditContactsCommand(config config, uplistingClient *uplisting.Client, textmagicClient *textmagic.Client, args []string) error {
+	now := time.Now()
+	since := now.Add(bookingLookback)
+	if len(args) > 0 {
+		var err error
+		if since, err = time.Parse("2006-01-02", args[0]); err != nil {
+			return err
+		}
+	}
+
+	lists, err := textmagicClient.GetLists()
+	if err != nil {
+		return err
+	}
+	var listId int
+	for _, list := range lists {
+		if list.Name == config.TextMagicListName {
+			listId = list.Id
+		}
+	}
+
+	properties, err := uplistingClient.GetProperties()
+	if err != nil {
+		return err
+	}
+	bookings := fetchBookings(uplistingClient, properties, since, now, config.UplistingWorkers, nil)
+	return auditContacts(os.Stdout, textmagicClient, bookings, listId)
+}
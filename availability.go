@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/matthewbloch/text-guests/uplisting"
+)
+
+/* Guests reply to ask whether we're free on their dates. "text-guests
+ * availability 2023-12-01 2023-12-04" checks Uplisting's calendars for a
+ * stay arriving on the first date and leaving on the second, optionally at
+ * one property, and drafts an answer to paste into TextMagic.
+ */
+
+var currencySymbols = map[string]string{"GBP": "£", "EUR": "€", "USD": "$"}
+
+// formatMoney is an amount the way a guest would write it.
+func formatMoney(amount float64, currency string) string {
+	if symbol, ok := currencySymbols[currency]; ok {
+		return fmt.Sprintf("%s%.0f", symbol, amount)
+	}
+	return fmt.Sprintf("%.0f %s", amount, currency)
+}
+
+// findProperty picks a property by Uplisting ID, name, nickname or domain.
+func findProperty(properties []uplisting.Property, key string) (uplisting.Property, bool) {
+	for _, p := range properties {
+		for _, k := range []string{p.ID, p.Name, p.Nickname, p.UplistingDomain} {
+			if k != "" && strings.EqualFold(k, key) {
+				return p, true
+			}
+		}
+	}
+	return uplisting.Property{}, false
+}
+
+// writeAvailability lists the free properties and their nightly rates.
+func writeAvailability(w io.Writer, available []uplisting.Availability) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PROPERTY\tNIGHTS\tRATES\tTOTAL")
+	for _, a := range available {
+		var rates []string
+		for _, night := range a.Nights {
+			rates = append(rates, fmt.Sprintf("%.2f", night.DayRate))
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%.2f %s\n", a.Property.Name, len(a.Nights), strings.Join(rates, " "), a.Total(), a.Property.Currency)
+	}
+	return tw.Flush()
+}
+
+// draftAvailabilityReply is an answer to a guest asking if we're free.
+func draftAvailabilityReply(available []uplisting.Availability, arrival, departure time.Time, property *uplisting.Property) string {
+	dates := arrival.Format("Mon 2 Jan") + " to " + departure.Format("Mon 2 Jan")
+	if len(available) == 0 {
+		if property != nil {
+			return "Sorry, " + property.Name + " isn't free from " + dates + "."
+		}
+		return "Sorry, we've nothing free from " + dates + "."
+	}
+	var offers []string
+	for _, a := range available {
+		offers = append(offers, fmt.Sprintf("%s for %s", a.Property.Name, formatMoney(a.Total(), a.Property.Currency)))
+	}
+	offered := offers[0]
+	if n := len(offers); n > 1 {
+		offered = strings.Join(offers[:n-1], ", ") + " or " + offers[n-1]
+	}
+	nights := fmt.Sprintf("%d nights", len(available[0].Nights))
+	if len(available[0].Nights) == 1 {
+		nights = "1 night"
+	}
+	return fmt.Sprintf("Good news, we're free from %s (%s): %s. Shall I book it for you?", dates, nights, offered)
+}
+
+// availabilityCommand prints which properties are free between two dates,
+// with a draft reply.
+func availabilityCommand(uplistingClient *uplisting.Client, args []string) error {
+	if len(args) < 2 || len(args) > 3 {
+		return errors.New("expected arrival and departure dates, YYYY-MM-DD, and optionally a property")
+	}
+	arrival, err := time.Parse("2006-01-02", args[0])
+	if err != nil {
+		return err
+	}
+	departure, err := time.Parse("2006-01-02", args[1])
+	if err != nil {
+		return err
+	}
+
+	var property *uplisting.Property
+	if len(args) == 3 {
+		properties, err := uplistingClient.GetProperties()
+		if err != nil {
+			return err
+		}
+		p, ok := findProperty(properties, args[2])
+		if !ok {
+			return fmt.Errorf("no property %q", args[2])
+		}
+		property = &p
+	}
+
+	available, err := uplistingClient.FreeProperties(arrival, departure, property)
+	if err != nil {
+		return err
+	}
+	if err := writeAvailability(os.Stdout, available); err != nil {
+		return err
+	}
+	fmt.Printf("\n%s\n", draftAvailabilityReply(available, arrival, departure, property))
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/matthewbloch/text-guests/textmagic"
+)
+
+// customFieldNames are the TextMagic custom fields this config refers to.
+func (c config) customFieldNames() (names []string) {
+	for _, name := range []string{
+		c.TextMagicContactStateName,
+		c.TextMagicLastPropertyName,
+		c.TextMagicLastStayName,
+		c.TextMagicStayCountName,
+		c.TextMagicLocaleName,
+	} {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// bootstrap creates any custom fields and lists the config needs which don't
+// already exist in the TextMagic account, reporting what it did. It's safe to
+// run as often as you like.
+func bootstrap(config config, client *textmagic.Client, w io.Writer) error {
+	fields, err := client.GetCustomFields()
+	if err != nil {
+		return fmt.Errorf("getting custom fields: %w", err)
+	}
+	for _, name := range config.customFieldNames() {
+		if field, ok := findCustomField(fields, name); ok {
+			fmt.Fprintf(w, "Custom field %q already exists (%d)\n", name, field.Id)
+			continue
+		}
+		field, err := client.CreateCustomField(name)
+		if err != nil {
+			return fmt.Errorf("creating custom field %q: %w", name, err)
+		}
+		fields = append(fields, field)
+		fmt.Fprintf(w, "Created custom field %q (%d)\n", name, field.Id)
+	}
+
+	lists, err := client.GetLists()
+	if err != nil {
+		return fmt.Errorf("getting lists: %w", err)
+	}
+	for _, list := range lists {
+		if list.Name == config.TextMagicListName {
+			fmt.Fprintf(w, "List %q already exists (%d)\n", list.Name, list.Id)
+			return nil
+		}
+	}
+	list, err := client.CreateList(config.TextMagicListName)
+	if err != nil {
+		return fmt.Errorf("creating list %q: %w", config.TextMagicListName, err)
+	}
+	fmt.Fprintf(w, "Created list %q (%d)\n", list.Name, list.Id)
+	return nil
+}
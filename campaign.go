@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/matthewbloch/text-guests/textmagic"
+	"github.com/matthewbloch/text-guests/uplisting"
+)
+
+// templateData is what the message templates can refer to, e.g. {{.FirstName}}
+// or {{.LastStay.PropertyName}}.
+type templateData struct {
+	FirstName    string
+	LastName     string
+	FirstStay    uplisting.Booking
+	LastStay     uplisting.Booking
+	Stays        []uplisting.Booking
+	StayCount    int
+	TotalNights  int
+	TotalRevenue float64
+	Channels     []string
+	DiscountCode string
+}
+
+func newTemplateData(g *guest, code string) templateData {
+	return templateData{
+		FirstName:    g.firstName(),
+		LastName:     strings.TrimSpace(g.contact.LastName),
+		FirstStay:    g.firstStay(),
+		LastStay:     g.lastStay(),
+		Stays:        g.stays,
+		StayCount:    len(g.stays),
+		TotalNights:  g.totalNights,
+		TotalRevenue: g.totalRevenue,
+		Channels:     g.channels,
+		DiscountCode: code,
+	}
+}
+
+// The templates every campaign needs.
+var templateNames = []string{"OLD", "RECENT", "DIRECT"}
+
+// configTemplate is a template's text from the config, where TEMPLATE_
+// variables have already overridden the config file.
+func (c config) configTemplate(name string) string {
+	return c.Templates[name]
+}
+
+// textMagicTemplates is the content of every TextMagic template, by name.
+// We fetch them all once, rather than page through them for every template
+// of every group in every language.
+func textMagicTemplates(client *textmagic.Client) (map[string]string, error) {
+	contents := make(map[string]string)
+	err := client.EachTemplate(func(t textmagic.Template) error {
+		// GetTemplateByName would find the first of any with the same name
+		if _, ok := contents[t.Name]; !ok {
+			contents[t.Name] = t.Content
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("TextMagic templates: %w", err)
+	}
+	return contents, nil
+}
+
+// templateTexts finds the text of each named template, either from the
+// config or from TextMagic's own templates, named with
+// TextMagicTemplatePrefix, as fetched by textMagicTemplates.
+func templateTexts(c config, fromTextMagic map[string]string, names []string) (map[string]string, error) {
+	texts := make(map[string]string)
+	switch c.TemplateSource {
+	case "env":
+		for _, name := range names {
+			texts[name] = c.configTemplate(name)
+		}
+	case "textmagic":
+		for _, name := range names {
+			text, ok := fromTextMagic[c.TextMagicTemplatePrefix+name]
+			if !ok {
+				return nil, fmt.Errorf("TextMagic template %q: %w", c.TextMagicTemplatePrefix+name, textmagic.ErrNotFound)
+			}
+			texts[name] = text
+		}
+	default:
+		return nil, fmt.Errorf("TEMPLATE_SOURCE must be env or textmagic, not %q", c.TemplateSource)
+	}
+	return texts, nil
+}
+
+// templateErrors is everything wrong with a set of templates, so it can all
+// be put right at once.
+type templateErrors []string
+
+func (e templateErrors) Error() string {
+	return strings.Join(e, "; ")
+}
+
+func parseTemplates(texts map[string]string) (map[string]*template.Template, templateErrors) {
+	names := make([]string, 0, len(texts))
+	for name := range texts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	templates := make(map[string]*template.Template)
+	var problems templateErrors
+	for _, name := range names {
+		if texts[name] == "" {
+			problems = append(problems, fmt.Sprintf("template %s is empty", name))
+			continue
+		}
+		t, err := template.New(name).Parse(texts[name])
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		templates[name] = t
+	}
+	for _, name := range templateNames {
+		if _, ok := texts[name]; !ok {
+			problems = append(problems, fmt.Sprintf("template %s is missing", name))
+		}
+	}
+	if len(problems) > 0 {
+		return nil, problems
+	}
+	return templates, nil
+}
+
+// pushTemplates copies the templates from the config, including any
+// variants, translations and groups' own templates, into TextMagic, so they can be edited
+// there and used with TEMPLATE_SOURCE=textmagic.
+func pushTemplates(c config, client *textmagic.Client, w io.Writer) error {
+	variants, err := parseTemplateVariants(c.TemplateVariants)
+	if err != nil {
+		return err
+	}
+	_, groups, err := c.propertyGroups()
+	if err != nil {
+		return err
+	}
+	for _, name := range c.allTemplateNames(variants) {
+		if err := pushTemplate(client, w, c.TextMagicTemplatePrefix+name, c.configTemplate(name)); err != nil {
+			return err
+		}
+		for _, group := range groups {
+			if err := pushTemplate(client, w, c.TextMagicTemplatePrefix+group+"_"+name, c.groupTemplate(group, name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func pushTemplate(client *textmagic.Client, w io.Writer, fullName, content string) error {
+	if content == "" {
+		return nil
+	}
+	existing, err := client.GetTemplateByName(fullName)
+	switch {
+	case err == textmagic.ErrNotFound:
+		t, err := client.CreateTemplate(fullName, content)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "Created template %q (%d)\n", fullName, t.Id)
+	case err != nil:
+		return err
+	case existing.Content == content:
+		fmt.Fprintf(w, "Template %q is already up to date (%d)\n", fullName, existing.Id)
+	default:
+		existing.Content = content
+		if err := client.UpdateTemplate(existing); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "Updated template %q (%d)\n", fullName, existing.Id)
+	}
+	return nil
+}
+
+func renderTemplate(t *template.Template, g *guest, code string) (string, error) {
+	var text strings.Builder
+	if err := t.Execute(&text, newTemplateData(g, code)); err != nil {
+		return "", err
+	}
+	return text.String(), nil
+}
+
+// We use TextMagic to store a custom field on each contact, so we can
+// remember what we last sent them, and when. If it was a variant of the
+// template, that comes third.
+func parseContactState(raw string) (lastTemplate string, lastSent time.Time) {
+	parts := strings.Split(raw, ",")
+	if len(parts) >= 2 {
+		lastTemplate = parts[0]
+
+		timeRaw, err := strconv.Atoi(parts[1])
+		if err == nil {
+			lastSent = time.Unix(int64(timeRaw), 0)
+		}
+	}
+	return lastTemplate, lastSent
+}
+
+func formatContactState(template, variant string, sent time.Time) string {
+	state := template + "," + strconv.Itoa(int(sent.Unix()))
+	if variant != template {
+		state += "," + variant
+	}
+	return state
+}
+
+// chooseTemplate decides what, if anything, to send a guest now, given what
+// we last sent them. If they shouldn't be texted, template is "" and reason
+// says why.
+func chooseTemplate(g *guest, lastTemplate string, lastSent, now time.Time) (template, reason string) {
+	lastStay := g.lastStay()
+
+	if lastStay.DepartureAt().After(now) {
+		/* Don't text people who are currently staying, or who have a booking in the future */
+		return "", "staying or booked"
+	}
+
+	switch lastTemplate {
+	case "":
+		if now.Sub(lastStay.DepartureAt()) < time.Hour*24*30 {
+			/* Send them the recent template if they've stayed in the last 30 days, and we've never texted them before */
+			template = "RECENT"
+		} else {
+			/* Send them the old template if they've stayed in the last year, and we've never texted them before */
+			template = "OLD"
+		}
+	case "OLD":
+		if lastStay.DepartureAt().After(lastSent) {
+			/* Send them the recent template if we've ever sent them the old template, and they've rebooked since */
+			template = "RECENT"
+		} else {
+			reason = "no stay since OLD"
+		}
+	case "RECENT":
+		if lastStay.DepartureAt().Sub(lastSent) > time.Hour*24*180 {
+			/* Send them the recent template if we've sent them the recent template before, and they last booked more than 180 days ago */
+			template = "RECENT"
+		} else {
+			reason = "RECENT sent recently"
+		}
+	default:
+		reason = "already sent " + lastTemplate
+	}
+
+	// Anyone who's booked via "uplisting" (i.e. directly) is a treasure, we have a template just for them.
+	if template != "" && lastStay.Channel == uplisting.ChannelUplisting {
+		template = "DIRECT"
+	}
+	return template, reason
+}
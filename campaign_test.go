@@ -0,0 +1,132 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matthewbloch/text-guests/uplisting"
+)
+
+func TestChooseTemplate(t *testing.T) {
+	now := time.Date(2023, 12, 1, 19, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+
+	tests := []struct {
+		name         string
+		stays        []uplisting.Booking
+		lastTemplate string
+		lastSent     time.Time
+		template     string
+		reason       string
+	}{
+		{
+			name:   "still staying",
+			stays:  []uplisting.Booking{stay(1, "2023-12-03", 3, 300, uplisting.ChannelAirbnb)},
+			reason: "staying or booked",
+		},
+		{
+			name: "booked again",
+			stays: []uplisting.Booking{
+				stay(1, "2023-11-04", 5, 500, uplisting.ChannelAirbnb),
+				stay(2, "2024-02-10", 2, 200, uplisting.ChannelAirbnb),
+			},
+			reason: "staying or booked",
+		},
+		{
+			name:     "never texted, stayed recently",
+			stays:    []uplisting.Booking{stay(1, "2023-11-20", 5, 500, uplisting.ChannelAirbnb)},
+			template: "RECENT",
+		},
+		{
+			name:     "never texted, stayed long ago",
+			stays:    []uplisting.Booking{stay(1, "2023-03-04", 5, 500, uplisting.ChannelAirbnb)},
+			template: "OLD",
+		},
+		{
+			name:         "OLD, stayed since",
+			stays:        []uplisting.Booking{stay(1, "2023-11-04", 5, 500, uplisting.ChannelAirbnb)},
+			lastTemplate: "OLD",
+			lastSent:     now.Add(-90 * day),
+			template:     "RECENT",
+		},
+		{
+			name:         "OLD, not stayed since",
+			stays:        []uplisting.Booking{stay(1, "2023-03-04", 5, 500, uplisting.ChannelAirbnb)},
+			lastTemplate: "OLD",
+			lastSent:     now.Add(-90 * day),
+			reason:       "no stay since OLD",
+		},
+		{
+			name:         "RECENT, stayed long after",
+			stays:        []uplisting.Booking{stay(1, "2023-11-04", 5, 500, uplisting.ChannelAirbnb)},
+			lastTemplate: "RECENT",
+			lastSent:     now.Add(-365 * day),
+			template:     "RECENT",
+		},
+		{
+			name:         "RECENT, sent recently",
+			stays:        []uplisting.Booking{stay(1, "2023-11-04", 5, 500, uplisting.ChannelAirbnb)},
+			lastTemplate: "RECENT",
+			lastSent:     now.Add(-60 * day),
+			reason:       "RECENT sent recently",
+		},
+		{
+			name:         "already DIRECT",
+			stays:        []uplisting.Booking{stay(1, "2023-11-04", 5, 500, uplisting.ChannelUplisting)},
+			lastTemplate: "DIRECT",
+			lastSent:     now.Add(-60 * day),
+			reason:       "already sent DIRECT",
+		},
+		{
+			name:     "never texted, last stay direct",
+			stays:    []uplisting.Booking{stay(1, "2023-11-20", 5, 500, uplisting.ChannelUplisting)},
+			template: "DIRECT",
+		},
+		{
+			name:         "OLD, stayed direct since",
+			stays:        []uplisting.Booking{stay(1, "2023-11-04", 5, 500, uplisting.ChannelUplisting)},
+			lastTemplate: "OLD",
+			lastSent:     now.Add(-90 * day),
+			template:     "DIRECT",
+		},
+		{
+			name:         "RECENT, stayed direct long after",
+			stays:        []uplisting.Booking{stay(1, "2023-11-04", 5, 500, uplisting.ChannelUplisting)},
+			lastTemplate: "RECENT",
+			lastSent:     now.Add(-365 * day),
+			template:     "DIRECT",
+		},
+		{
+			name: "direct once, but not last time",
+			stays: []uplisting.Booking{
+				stay(1, "2022-06-10", 2, 200, uplisting.ChannelUplisting),
+				stay(2, "2023-11-20", 5, 500, uplisting.ChannelAirbnb),
+			},
+			template: "RECENT",
+		},
+		{
+			name: "direct last time",
+			stays: []uplisting.Booking{
+				stay(1, "2022-06-10", 2, 200, uplisting.ChannelAirbnb),
+				stay(2, "2023-11-20", 5, 500, uplisting.ChannelUplisting),
+			},
+			template: "DIRECT",
+		},
+		{
+			name:         "direct, but not due anything",
+			stays:        []uplisting.Booking{stay(1, "2023-03-04", 5, 500, uplisting.ChannelUplisting)},
+			lastTemplate: "OLD",
+			lastSent:     now.Add(-90 * day),
+			reason:       "no stay since OLD",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := newGuest(&identity{bookings: test.stays})
+			template, reason := chooseTemplate(g, test.lastTemplate, test.lastSent, now)
+			if template != test.template || reason != test.reason {
+				t.Errorf("chooseTemplate = %q, %q, want %q, %q", template, reason, test.template, test.reason)
+			}
+		})
+	}
+}
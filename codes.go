@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Letters and digits that can't be mistaken for each other when read off a
+// phone screen: no 0/O, 1/I/L.
+const discountCodeAlphabet = "ABCDEFGHJKMNPQRSTUVWXYZ23456789"
+
+// discountCode is a code we've issued to one guest for one campaign.
+type discountCode struct {
+	Code      string    `json:"code"`
+	Campaign  string    `json:"campaign"`
+	Phone     string    `json:"phone"`
+	Email     string    `json:"email,omitempty"`
+	ContactId int       `json:"contact_id"`
+	IssuedAt  time.Time `json:"issued_at"`
+	SentAt    time.Time `json:"sent_at"`
+}
+
+func randomCode(prefix string, length int) (string, error) {
+	code := []byte(prefix)
+	max := big.NewInt(int64(len(discountCodeAlphabet)))
+	for i := 0; i < length; i++ {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code = append(code, discountCodeAlphabet[n.Int64()])
+	}
+	return string(code), nil
+}
+
+// discountCode returns the code for the text we're about to send a guest
+// for a campaign. A text that failed to send gets the same code next time,
+// but once one has gone out, the next text gets a new code: the old one
+// may well have been used.
+func (s *store) discountCode(g *guest, campaign, prefix string, length int) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	phone := g.phone()
+	for _, code := range s.data.Codes {
+		if code.Phone == phone && code.Campaign == campaign && code.SentAt.IsZero() {
+			return code.Code, nil
+		}
+	}
+
+	for {
+		code, err := randomCode(prefix, length)
+		if err != nil {
+			return "", err
+		}
+		taken := false
+		for _, existing := range s.data.Codes {
+			taken = taken || existing.Code == code
+		}
+		if taken {
+			continue
+		}
+		s.data.Codes = append(s.data.Codes, discountCode{
+			Code:      code,
+			Campaign:  campaign,
+			Phone:     phone,
+			Email:     g.email(),
+			ContactId: g.contact.Id,
+			IssuedAt:  time.Now(),
+		})
+		return code, nil
+	}
+}
+
+// codeSent notes that the text with this code went out.
+func (s *store) codeSent(code string, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.data.Codes {
+		if s.data.Codes[i].Code == code {
+			s.data.Codes[i].SentAt = at
+		}
+	}
+}
+
+func (s *store) discountCodes() []discountCode {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]discountCode(nil), s.data.Codes...)
+}
+
+// writeDiscountCodes writes every code we've issued as CSV, for loading into
+// the booking site.
+func writeDiscountCodes(w io.Writer, codes []discountCode) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"code", "campaign", "phone", "email", "contact_id", "issued_at", "sent_at"})
+	for _, code := range codes {
+		sentAt := ""
+		if !code.SentAt.IsZero() {
+			sentAt = code.SentAt.Format(time.RFC3339)
+		}
+		cw.Write([]string{
+			code.Code, code.Campaign, code.Phone, code.Email, strconv.Itoa(code.ContactId),
+			code.IssuedAt.Format(time.RFC3339), sentAt,
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// exportCodesCommand writes the codes to the file given, or stdout.
+func exportCodesCommand(config config, args []string) error {
+	store, err := openStore(config.StateFile)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 || args[0] == "-" {
+		return writeDiscountCodes(os.Stdout, store.discountCodes())
+	}
+	f, err := os.Create(args[0])
+	if err != nil {
+		return err
+	}
+	codes := store.discountCodes()
+	if err := writeDiscountCodes(f, codes); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Wrote %d codes to %s\n", len(codes), args[0])
+	return nil
+}
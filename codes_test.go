@@ -0,0 +1,94 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matthewbloch/text-guests/textmagic"
+	"github.com/matthewbloch/text-guests/uplisting"
+)
+
+func testStore(t *testing.T) *store {
+	t.Helper()
+	s, err := openStore(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestDiscountCode(t *testing.T) {
+	s := testStore(t)
+	doris := newGuest(&identity{bookings: []uplisting.Booking{stay(1, "2023-11-04", 5, 500, uplisting.ChannelAirbnb)}})
+	doris.contact = textmagic.Contact{Id: 42}
+	other := stay(2, "2023-11-04", 5, 500, uplisting.ChannelAirbnb)
+	other.GuestPhone = "+447700900456"
+	ahmed := newGuest(&identity{bookings: []uplisting.Booking{other}})
+
+	issue := func(g *guest, campaign string) string {
+		t.Helper()
+		code, err := s.discountCode(g, campaign, "YH", 8)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+
+	first := issue(doris, "RECENT")
+	if len(first) != 10 || !strings.HasPrefix(first, "YH") || strings.Trim(first[2:], discountCodeAlphabet) != "" {
+		t.Errorf("code %q isn't YH and 8 of %s", first, discountCodeAlphabet)
+	}
+	if again := issue(doris, "RECENT"); again != first {
+		t.Errorf("text that didn't go out got a new code %q, want %q", again, first)
+	}
+	if old := issue(doris, "OLD"); old == first {
+		t.Error("two campaigns got the same code")
+	}
+	if theirs := issue(ahmed, "RECENT"); theirs == first {
+		t.Error("two guests got the same code")
+	}
+
+	// Once it's gone out, the guest's next RECENT needs a code of its own
+	s.codeSent(first, time.Date(2023, 11, 4, 19, 0, 0, 0, time.UTC))
+	next := issue(doris, "RECENT")
+	if next == first {
+		t.Errorf("reissued %q, which has already been sent", first)
+	}
+	if again := issue(doris, "RECENT"); again != next {
+		t.Errorf("got %q, want the unsent %q", again, next)
+	}
+	if n := len(s.discountCodes()); n != 4 {
+		t.Errorf("issued %d codes, want 4", n)
+	}
+
+	// and the same goes for the next run
+	if err := s.save(); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := openStore(s.path); err != nil {
+		t.Fatal(err)
+	} else if again, _ := s.discountCode(doris, "RECENT", "YH", 8); again != next {
+		t.Errorf("after saving got %q, want the unsent %q", again, next)
+	}
+}
+
+func TestWriteDiscountCodes(t *testing.T) {
+	issued := time.Date(2023, 11, 4, 12, 0, 0, 0, time.UTC)
+	codes := []discountCode{
+		{Code: "YH7K3M9QPX", Campaign: "RECENT", Phone: "447700900123", Email: "doris@example.com", ContactId: 42, IssuedAt: issued, SentAt: issued.Add(7 * time.Hour)},
+		{Code: "YHW4TR8N2A", Campaign: "OLD", Phone: "447700900456", IssuedAt: issued},
+	}
+	var out strings.Builder
+	if err := writeDiscountCodes(&out, codes); err != nil {
+		t.Fatal(err)
+	}
+	want := `code,campaign,phone,email,contact_id,issued_at,sent_at
+YH7K3M9QPX,RECENT,447700900123,doris@example.com,42,2023-11-04T12:00:00Z,2023-11-04T19:00:00Z
+YHW4TR8N2A,OLD,447700900456,,0,2023-11-04T12:00:00Z,
+`
+	if out.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", out.String(), want)
+	}
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/caarlos0/env"
+	"gopkg.in/yaml.v3"
+)
+
+/* Configuration comes from an optional YAML file, CONFIG_FILE, then from
+ * environment variables (and .env), which override anything in the file.
+ * Each setting's YAML key is its variable's name in lower case. Templates
+ * and property groups are easier to write in the file, which has room for
+ * multi-line text and lists.
+ */
+
+type config struct {
+	TextMagicUsername string `env:"TEXTMAGIC_USERNAME" yaml:"textmagic_username"`
+	TextMagicApiKey   string `env:"TEXTMAGIC_API_KEY" yaml:"textmagic_api_key"`
+	TextMagicApiBase  string `env:"TEXTMAGIC_API_BASE" yaml:"textmagic_api_base"`
+
+	TextMagicContactStateName string `env:"TEXTMAGIC_CONTACT_STATE_NAME" yaml:"textmagic_contact_state_name"`
+	TextMagicListName         string `env:"TEXTMAGIC_LIST_NAME" yaml:"textmagic_list_name"`
+
+	// Optional custom fields we keep up to date from each guest's bookings
+	TextMagicLastPropertyName string `env:"TEXTMAGIC_LAST_PROPERTY_NAME" yaml:"textmagic_last_property_name"`
+	TextMagicLastStayName     string `env:"TEXTMAGIC_LAST_STAY_NAME" yaml:"textmagic_last_stay_name"`
+	TextMagicStayCountName    string `env:"TEXTMAGIC_STAY_COUNT_NAME" yaml:"textmagic_stay_count_name"`
+
+	// Optional prefixes for lists of guests per property, and per template sent
+	TextMagicPropertyListPrefix string `env:"TEXTMAGIC_PROPERTY_LIST_PREFIX" yaml:"textmagic_property_list_prefix"`
+	TextMagicCampaignListPrefix string `env:"TEXTMAGIC_CAMPAIGN_LIST_PREFIX" yaml:"textmagic_campaign_list_prefix"`
+
+	UplistingApiKey  string `env:"UPLISTING_API_KEY" yaml:"uplisting_api_key"`
+	UplistingApiBase string `env:"UPLISTING_API_BASE" yaml:"uplisting_api_base"`
+
+	// Where to find the message templates: "env" for the variables below, or
+	// "textmagic" for TextMagic templates named e.g. "Rebook: RECENT"
+	TemplateSource          string `env:"TEMPLATE_SOURCE" yaml:"template_source"`
+	TextMagicTemplatePrefix string `env:"TEXTMAGIC_TEMPLATE_PREFIX" yaml:"textmagic_template_prefix"`
+
+	// Templates by name, e.g. RECENT, RECENT_B or RECENT_fr, from the config
+	// file. TEMPLATE_ variables, e.g. TEMPLATE_RECENT, override these.
+	Templates map[string]string `yaml:"templates"`
+
+	// Languages we have templates in, besides the default, which countries
+	// speak which, and an optional custom field to override it per contact
+	DefaultLocale       string   `env:"DEFAULT_LOCALE" yaml:"default_locale"`
+	Locales             []string `env:"LOCALES" yaml:"locales"`
+	LocaleCountries     []string `env:"LOCALE_COUNTRIES" yaml:"locale_countries"`
+	TextMagicLocaleName string   `env:"TEXTMAGIC_LOCALE_NAME" yaml:"textmagic_locale_name"`
+
+	// Who our texts come from, unless a property group has its own sender,
+	// and which properties are in which group. TEXTMAGIC_FROM_<GROUP>
+	// variables override Senders.
+	TextMagicFrom  string            `env:"TEXTMAGIC_FROM" yaml:"textmagic_from"`
+	Senders        map[string]string `yaml:"senders"`
+	PropertyGroups []string          `env:"PROPERTY_GROUPS" yaml:"property_groups"`
+	Groups         []groupConfig     `yaml:"groups"`
+
+	// Weighted variants of the templates to compare, e.g. RECENT:50,RECENT_B:50
+	TemplateVariants []string `env:"TEMPLATE_VARIANTS" yaml:"template_variants"`
+
+	// Each text we send gets its own discount code, {{.DiscountCode}}
+	DiscountCodePrefix string `env:"DISCOUNT_CODE_PREFIX" yaml:"discount_code_prefix"`
+	DiscountCodeLength int    `env:"DISCOUNT_CODE_LENGTH" yaml:"discount_code_length"`
+
+	IdentityMinConfidence float64 `env:"IDENTITY_MIN_CONFIDENCE" yaml:"identity_min_confidence"`
+
+	// How many requests we make to each API at once, and how many per second
+	UplistingWorkers   int     `env:"UPLISTING_WORKERS" yaml:"uplisting_workers"`
+	UplistingRateLimit float64 `env:"UPLISTING_RATE_LIMIT" yaml:"uplisting_rate_limit"`
+	TextMagicWorkers   int     `env:"TEXTMAGIC_WORKERS" yaml:"textmagic_workers"`
+	TextMagicRateLimit float64 `env:"TEXTMAGIC_RATE_LIMIT" yaml:"textmagic_rate_limit"`
+
+	// Log every API request and response, redacted, at debug level
+	DebugHTTP          bool `env:"DEBUG_HTTP" yaml:"debug_http"`
+	DebugHTTPBodyLimit int  `env:"DEBUG_HTTP_BODY_LIMIT" yaml:"debug_http_body_limit"`
+
+	// Where to write a JSON report of each run, "-" for stdout
+	ReportFile string `env:"REPORT_FILE" yaml:"report_file"`
+
+	// Our own record of what we've sent, and how long after a text we credit
+	// it with a guest's booking
+	StateFile         string        `env:"STATE_FILE" yaml:"state_file"`
+	AttributionWindow time.Duration `env:"ATTRIBUTION_WINDOW" yaml:"attribution_window"`
+
+	// How often the daemon runs, and where it serves /metrics, if anywhere
+	DaemonInterval time.Duration `env:"DAEMON_INTERVAL" yaml:"daemon_interval"`
+	ListenAddr     string        `env:"LISTEN_ADDR" yaml:"listen_addr"`
+
+	// The secret Uplisting's booking webhooks are signed with, and the header
+	// the signature comes in; without a secret we don't take webhooks
+	UplistingWebhookSecret          string `env:"UPLISTING_WEBHOOK_SECRET" yaml:"uplisting_webhook_secret"`
+	UplistingWebhookSignatureHeader string `env:"UPLISTING_WEBHOOK_SIGNATURE_HEADER" yaml:"uplisting_webhook_signature_header"`
+
+	// TextMagic's reply and delivery callbacks carry this secret as ?token=;
+	// without it we don't take them
+	TextMagicWebhookSecret string `env:"TEXTMAGIC_WEBHOOK_SECRET" yaml:"textmagic_webhook_secret"`
+
+	// Replies which whole match one of these opt the guest out
+	OptOutKeywords []string `env:"OPT_OUT_KEYWORDS" yaml:"opt_out_keywords"`
+
+	// Where other replies are passed on to: an email through SMTPAddr, and/or
+	// a JSON POST to ReplyForwardURL
+	ReplyForwardEmail string `env:"REPLY_FORWARD_EMAIL" yaml:"reply_forward_email"`
+	ReplyForwardFrom  string `env:"REPLY_FORWARD_FROM" yaml:"reply_forward_from"`
+	SMTPAddr          string `env:"SMTP_ADDR" yaml:"smtp_addr"`
+	ReplyForwardURL   string `env:"REPLY_FORWARD_URL" yaml:"reply_forward_url"`
+
+	// Send one message to all the guests due the same text at the same time
+	BatchSend bool `env:"BATCH_SEND" yaml:"batch_send"`
+	BatchSize int  `env:"BATCH_SIZE" yaml:"batch_size"`
+
+	// Other accounts to run for, each overriding some of the above, and which
+	// one this is
+	Tenants []tenantConfig `yaml:"tenants"`
+	Tenant  string         `yaml:"-"`
+}
+
+// groupConfig is a group of properties, from the config file, with its own
+// templates and sender. See groups.go.
+type groupConfig struct {
+	Name       string            `yaml:"name"`
+	Properties []string          `yaml:"properties"`
+	From       string            `yaml:"from"`
+	Templates  map[string]string `yaml:"templates"`
+}
+
+// The config file we read if CONFIG_FILE isn't set, as long as it exists.
+const defaultConfigFile = "text-guests.yaml"
+
+func defaultConfig() config {
+	return config{
+		TextMagicApiBase:                "https://rest.textmagic.com",
+		UplistingApiBase:                "https://connect.uplisting.io",
+		TemplateSource:                  "env",
+		TextMagicTemplatePrefix:         "Rebook: ",
+		DefaultLocale:                   "en",
+		DiscountCodeLength:              8,
+		IdentityMinConfidence:           0.9,
+		UplistingWorkers:                4,
+		UplistingRateLimit:              5,
+		TextMagicWorkers:                4,
+		TextMagicRateLimit:              2,
+		DebugHTTPBodyLimit:              2000,
+		StateFile:                       "text-guests-state.json",
+		AttributionWindow:               time.Hour * 24 * 90,
+		DaemonInterval:                  time.Hour * 24,
+		UplistingWebhookSignatureHeader: "X-Uplisting-Signature",
+		OptOutKeywords:                  []string{"STOP", "STOPALL", "UNSUBSCRIBE", "END", "QUIT", "OPTOUT"},
+		ReplyForwardFrom:                "text-guests@localhost",
+		SMTPAddr:                        "localhost:25",
+		BatchSize:                       100,
+	}
+}
+
+// loadConfig reads the defaults, then the config file, then the environment.
+// It doesn't check the result; that's validate's job.
+func loadConfig() (config, error) {
+	c := defaultConfig()
+
+	path, explicit := os.LookupEnv("CONFIG_FILE")
+	if !explicit {
+		path = defaultConfigFile
+	}
+	if path != "" {
+		f, err := os.Open(path)
+		switch {
+		case errors.Is(err, os.ErrNotExist) && !explicit:
+		case err != nil:
+			return c, err
+		default:
+			defer f.Close()
+			decoder := yaml.NewDecoder(f)
+			decoder.KnownFields(true)
+			if err := decoder.Decode(&c); err != nil && err != io.EOF {
+				return c, fmt.Errorf("%s: %w", path, err)
+			}
+		}
+	}
+
+	if err := env.Parse(&c); err != nil {
+		return c, err
+	}
+	c.readEnvironment(os.Environ())
+	return c, nil
+}
+
+// readEnvironment copies the templates and senders that can't be fields,
+// e.g. TEMPLATE_RECENT_fr or TEXTMAGIC_FROM_LEEDS, into the config, where a
+// tenant's own settings can override them like any other. Those for a group
+// in the config file go on the group.
+func (c *config) readEnvironment(environ []string) {
+	for _, variable := range environ {
+		key, value, _ := strings.Cut(variable, "=")
+		if value == "" {
+			continue
+		}
+		switch {
+		case key == "TEMPLATE_SOURCE" || key == "TEMPLATE_VARIANTS":
+		case strings.HasPrefix(key, "TEMPLATE_"):
+			name := strings.TrimPrefix(key, "TEMPLATE_")
+			if g, rest := c.groupFor(name); g != nil {
+				if g.Templates == nil {
+					g.Templates = make(map[string]string)
+				}
+				g.Templates[rest] = value
+				continue
+			}
+			if c.Templates == nil {
+				c.Templates = make(map[string]string)
+			}
+			c.Templates[name] = value
+		case strings.HasPrefix(key, "TEXTMAGIC_FROM_"):
+			name := strings.TrimPrefix(key, "TEXTMAGIC_FROM_")
+			if g, rest := c.groupFor(name + "_"); g != nil && rest == "" {
+				g.From = value
+				continue
+			}
+			if c.Senders == nil {
+				c.Senders = make(map[string]string)
+			}
+			c.Senders[name] = value
+		}
+	}
+}
+
+// groupFor finds the group in the config file that a name like LEEDS_RECENT
+// starts with, and what's left of the name after it.
+func (c *config) groupFor(name string) (*groupConfig, string) {
+	var found *groupConfig
+	longest := 0
+	for i, g := range c.Groups {
+		prefix := strings.ToUpper(strings.TrimSpace(g.Name)) + "_"
+		// YORK_CITY_RECENT is YORK_CITY's, not YORK's
+		if prefix != "_" && strings.HasPrefix(name, prefix) && len(prefix) > longest {
+			found, longest = &c.Groups[i], len(prefix)
+		}
+	}
+	return found, name[longest:]
+}
+
+// configErrors is everything wrong with a config, one problem per line, each
+// starting with the path to the setting.
+type configErrors []string
+
+func (e configErrors) Error() string {
+	return "invalid config:\n  " + strings.Join(e, "\n  ")
+}
+
+func (e *configErrors) add(path, format string, args ...any) {
+	*e = append(*e, path+": "+fmt.Sprintf(format, args...))
+}
+
+// validate checks the config, or every tenant's, without talking to any
+// API. Templates are only checked here if they come from the config rather
+// than TextMagic.
+func (c config) validate() error {
+	if len(c.Tenants) == 0 {
+		return c.validateTenant()
+	}
+	tenants, err := c.tenants()
+	if err != nil {
+		return err
+	}
+	var problems configErrors
+	for i, tenant := range tenants {
+		if errs, ok := tenant.validateTenant().(configErrors); ok {
+			for _, problem := range errs {
+				problems = append(problems, fmt.Sprintf("tenants[%d].%s", i, problem))
+			}
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return problems
+}
+
+func (c config) validateTenant() error {
+	var problems configErrors
+
+	for _, required := range []struct{ path, value string }{
+		{"textmagic_username", c.TextMagicUsername},
+		{"textmagic_api_key", c.TextMagicApiKey},
+		{"textmagic_contact_state_name", c.TextMagicContactStateName},
+		{"textmagic_list_name", c.TextMagicListName},
+		{"uplisting_api_key", c.UplistingApiKey},
+	} {
+		if required.value == "" {
+			problems.add(required.path, "required (or set %s)", strings.ToUpper(required.path))
+		}
+	}
+
+	if c.TemplateSource != "env" && c.TemplateSource != "textmagic" {
+		problems.add("template_source", "must be env or textmagic, not %q", c.TemplateSource)
+	}
+	if c.IdentityMinConfidence <= 0 || c.IdentityMinConfidence > 1 {
+		problems.add("identity_min_confidence", "must be more than 0 and at most 1")
+	}
+	for _, positive := range []struct {
+		path  string
+		value float64
+	}{
+		{"uplisting_workers", float64(c.UplistingWorkers)},
+		{"uplisting_rate_limit", c.UplistingRateLimit},
+		{"textmagic_workers", float64(c.TextMagicWorkers)},
+		{"textmagic_rate_limit", c.TextMagicRateLimit},
+		{"batch_size", float64(c.BatchSize)},
+		{"discount_code_length", float64(c.DiscountCodeLength)},
+		{"attribution_window", float64(c.AttributionWindow)},
+		{"daemon_interval", float64(c.DaemonInterval)},
+	} {
+		if positive.value <= 0 {
+			problems.add(positive.path, "must be more than 0")
+		}
+	}
+
+	variants, variantsErr := parseTemplateVariants(c.TemplateVariants)
+	if variantsErr != nil {
+		problems.add("template_variants", "%v", variantsErr)
+	}
+	if _, err := c.localeCountries(); err != nil {
+		problems.add("locale_countries", "%v", err)
+	}
+	_, groups, groupsErr := c.propertyGroups()
+	if groupsErr != nil {
+		problems.add("property_groups", "%v", groupsErr)
+	}
+	for i, group := range c.Groups {
+		if group.Name == "" {
+			problems.add(fmt.Sprintf("groups[%d].name", i), "required")
+		}
+		if len(group.Properties) == 0 {
+			problems.add(fmt.Sprintf("groups[%d].properties", i), "must list at least one property")
+		}
+	}
+
+	if c.ReplyForwardURL != "" {
+		if u, err := url.Parse(c.ReplyForwardURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			problems.add("reply_forward_url", "must be an http or https URL")
+		}
+	}
+
+	// Without the variants and groups we can't tell which templates we need
+	if c.TemplateSource == "env" && variantsErr == nil && groupsErr == nil {
+		if _, err := loadTemplateSets(c, nil, variants, groups); err != nil {
+			if errs, ok := err.(templateErrors); ok {
+				for _, problem := range errs {
+					problems.add("templates", "%s", problem)
+				}
+			} else {
+				problems.add("templates", "%v", err)
+			}
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return problems
+}
+
+// checkConfigCommand says whether the config is valid.
+func checkConfigCommand(c config, w io.Writer) error {
+	if err := c.validate(); err != nil {
+		return err
+	}
+	fmt.Fprintln(w, "Config OK")
+	return nil
+}
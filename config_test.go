@@ -0,0 +1,78 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// validConfig is a config which passes validate, for tests to break.
+func validConfig() config {
+	c := defaultConfig()
+	c.TextMagicUsername = "york"
+	c.TextMagicApiKey = "key"
+	c.TextMagicContactStateName = "Rebook state"
+	c.TextMagicListName = "Guests"
+	c.UplistingApiKey = "key"
+	c.Templates = map[string]string{
+		"OLD":    "Come back, {{.FirstName}}",
+		"RECENT": "Thanks, {{.FirstName}}",
+		"DIRECT": "Thanks for booking direct, {{.FirstName}}",
+	}
+	return c
+}
+
+func TestValidate(t *testing.T) {
+	if err := validConfig().validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateMissingTranslations(t *testing.T) {
+	c := validConfig()
+	c.Locales = []string{"fr", "de"}
+	c.Templates["OLD_fr"] = "Revenez, {{.FirstName}}"
+	c.Templates["RECENT_fr"] = "Merci, {{.FirstName}}"
+	c.Templates["OLD_de"] = "Kommen Sie wieder, {{.FirstName}}"
+
+	err := c.validate()
+	want := configErrors{
+		"templates: template DIRECT_de is empty",
+		"templates: template DIRECT_fr is empty",
+		"templates: template RECENT_de is empty",
+	}
+	if got, _ := err.(configErrors); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", err, want)
+	}
+}
+
+// Templates aren't checked when we can't tell which we need.
+func TestValidateSkipsTemplatesAfterBadVariantsOrGroups(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *config)
+		path   string
+	}{
+		{
+			name:   "bad variants",
+			modify: func(c *config) { c.TemplateVariants = []string{"RECENT_B:x"} },
+			path:   "template_variants",
+		},
+		{
+			name:   "bad groups",
+			modify: func(c *config) { c.PropertyGroups = []string{"Agar Street"} },
+			path:   "property_groups",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := validConfig()
+			delete(c.Templates, "DIRECT")
+			test.modify(&c)
+			errs, _ := c.validate().(configErrors)
+			if len(errs) != 1 || !strings.HasPrefix(errs[0], test.path+": ") {
+				t.Errorf("got %v, want just a problem with %s", errs, test.path)
+			}
+		})
+	}
+}
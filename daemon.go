@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// daemon runs the campaign for every tenant each DaemonInterval until it's
+// interrupted, serving metrics and webhooks on ListenAddr if it's set. A
+// failed run is reported, and we try again next time.
+func daemon(config config, tenants []config) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	handleWebhooks(mux, tenants)
+
+	serverErrors := make(chan error, 1)
+	var server *http.Server
+	if config.ListenAddr != "" {
+		server = &http.Server{Addr: config.ListenAddr, Handler: mux}
+		go func() {
+			slog.Info("Listening", "addr", config.ListenAddr)
+			if err := server.ListenAndServe(); err != http.ErrServerClosed {
+				serverErrors <- err
+			}
+		}()
+	}
+
+	for {
+		if err := runTenants(tenants); err != nil {
+			slog.Error("Run failed:", "error", err)
+		}
+		slog.Info("Next run", "at", time.Now().Add(config.DaemonInterval))
+
+		select {
+		case <-time.After(config.DaemonInterval):
+		case err := <-serverErrors:
+			return err
+		case <-ctx.Done():
+			if server != nil {
+				shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				defer cancel()
+				err := server.Shutdown(shutdownCtx)
+				// Don't leave a guest texted but not recorded as such
+				webhookActions.Wait()
+				return err
+			}
+			return nil
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+const redacted = "REDACTED"
+
+// Headers which carry our API credentials.
+var secretHeaders = []string{"Authorization", "X-TM-Key", "Cookie", "Set-Cookie"}
+
+// JSON keys, from either API, whose values identify a guest. Message text is
+// included since it's addressed to them by name.
+var piiKeys = map[string]bool{
+	"guest_name": true, "preferred_guest_name": true, "guest_email": true, "guest_phone": true, "note": true,
+	"firstname": true, "lastname": true, "first_name": true, "last_name": true,
+	"phone": true, "phones": true, "email": true, "receiver": true, "sender": true, "text": true,
+}
+
+// Query parameters we might search for a guest with.
+var piiParams = []string{"query", "phone", "phones", "email"}
+
+// e.g. /api/v2/contacts/phone/+447700900123
+var phoneInPath = regexp.MustCompile(`/phone/[^/?]+`)
+
+// debugTransport logs every request and response at debug level, with
+// credentials and guest details redacted and bodies cut short.
+type debugTransport struct {
+	api       string
+	bodyLimit int
+	next      http.RoundTripper
+}
+
+func (t *debugTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	var requestBody []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		var err error
+		if requestBody, err = io.ReadAll(r.Body); err != nil {
+			return nil, err
+		}
+		r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewReader(requestBody))
+	}
+
+	start := time.Now()
+	resp, err := t.next.RoundTrip(r)
+	attrs := []any{
+		"api", t.api,
+		"method", r.Method,
+		"url", redactURL(r.URL),
+		"latency", time.Since(start),
+		"requestHeaders", redactHeaders(r.Header),
+		"requestBody", t.redactBody(requestBody),
+	}
+	if err != nil {
+		slog.Debug("HTTP request failed", append(attrs, "error", err)...)
+		return resp, err
+	}
+
+	responseBody, readErr := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(responseBody))
+	if readErr != nil {
+		slog.Debug("HTTP response unreadable", append(attrs, "status", resp.StatusCode, "error", readErr)...)
+		return nil, readErr
+	}
+
+	slog.Debug("HTTP", append(attrs,
+		"status", resp.StatusCode,
+		"responseHeaders", redactHeaders(resp.Header),
+		"responseBody", t.redactBody(responseBody),
+	)...)
+	return resp, nil
+}
+
+func redactURL(u *url.URL) string {
+	redactedURL := *u
+	redactedURL.Path = phoneInPath.ReplaceAllString(u.Path, "/phone/"+redacted)
+	redactedURL.RawPath = ""
+	query := u.Query()
+	for _, param := range piiParams {
+		if query.Has(param) {
+			query.Set(param, redacted)
+		}
+	}
+	redactedURL.RawQuery = query.Encode()
+	return redactedURL.String()
+}
+
+func redactHeaders(h http.Header) http.Header {
+	h = h.Clone()
+	for _, name := range secretHeaders {
+		if h.Get(name) != "" {
+			h.Set(name, redacted)
+		}
+	}
+	return h
+}
+
+func (t *debugTransport) redactBody(body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+	var decoded any
+	if err := json.Unmarshal(body, &decoded); err != nil {
+		// We can't pick the guest's details out, so don't show any of it
+		return "(" + http.DetectContentType(body) + ", not shown)"
+	}
+	redactedBody, err := json.Marshal(redactValue(decoded))
+	if err != nil {
+		return "(unprintable)"
+	}
+	if t.bodyLimit > 0 && len(redactedBody) > t.bodyLimit {
+		return string(redactedBody[:t.bodyLimit]) + "..."
+	}
+	return string(redactedBody)
+}
+
+func redactValue(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, value := range v {
+			if piiKeys[strings.ToLower(key)] && value != nil {
+				v[key] = redacted
+			} else {
+				v[key] = redactValue(value)
+			}
+		}
+	case []any:
+		for i := range v {
+			v[i] = redactValue(v[i])
+		}
+	}
+	return v
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"golang.org/x/exp/slog"
+)
+
+func TestRedactURL(t *testing.T) {
+	tests := map[string]string{
+		"https://rest.textmagic.com/api/v2/ping":                                "https://rest.textmagic.com/api/v2/ping",
+		"https://rest.textmagic.com/api/v2/contacts/phone/447700900123":         "https://rest.textmagic.com/api/v2/contacts/phone/REDACTED",
+		"https://rest.textmagic.com/api/v2/contacts/phone/%2B447700900123?a=1":  "https://rest.textmagic.com/api/v2/contacts/phone/REDACTED?a=1",
+		"https://rest.textmagic.com/api/v2/contacts/search?query=Doris&page=2":  "https://rest.textmagic.com/api/v2/contacts/search?page=2&query=REDACTED",
+		"https://rest.textmagic.com/api/v2/contacts/search?phone=447700900123":  "https://rest.textmagic.com/api/v2/contacts/search?phone=REDACTED",
+		"https://rest.textmagic.com/api/v2/contacts/search?email=d%40example.c": "https://rest.textmagic.com/api/v2/contacts/search?email=REDACTED",
+		"https://connect.uplisting.io/bookings/7458?from=2023-11-01":            "https://connect.uplisting.io/bookings/7458?from=2023-11-01",
+	}
+	for raw, want := range tests {
+		u, err := url.Parse(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := redactURL(u); got != want {
+			t.Errorf("redactURL(%s) = %s, want %s", raw, got, want)
+		}
+		if u.String() != raw {
+			t.Errorf("redactURL(%s) changed the request's URL", raw)
+		}
+	}
+}
+
+func TestRedactHeaders(t *testing.T) {
+	h := http.Header{}
+	h.Set("Authorization", "Basic a2V5Og==")
+	h.Set("X-TM-Username", "yorkholiday")
+	h.Set("X-TM-Key", "tm-secret")
+	h.Set("Cookie", "session=1")
+	h.Set("Content-Type", "application/json")
+
+	got := redactHeaders(h)
+	for name, want := range map[string]string{
+		"Authorization": redacted,
+		"X-TM-Key":      redacted,
+		"Cookie":        redacted,
+		"X-TM-Username": "yorkholiday",
+		"Content-Type":  "application/json",
+	} {
+		if got.Get(name) != want {
+			t.Errorf("%s: %q, want %q", name, got.Get(name), want)
+		}
+	}
+	if h.Get("X-TM-Key") != "tm-secret" {
+		t.Error("redacted the request's own headers")
+	}
+}
+
+func TestRedactBody(t *testing.T) {
+	tests := []struct {
+		name, body, want string
+		limit            int
+	}{
+		{
+			name: "Uplisting booking",
+			body: `{"data":[{"id":"1","attributes":{"guest_name":"Doris Rodríguez","guest_email":"doris@example.com","guest_phone":"+447700900123","preferred_guest_name":null,"check_in":"2023-11-01"}}]}`,
+			want: `{"data":[{"attributes":{"check_in":"2023-11-01","guest_email":"REDACTED","guest_name":"REDACTED","guest_phone":"REDACTED","preferred_guest_name":null},"id":"1"}]}`,
+		},
+		{
+			name: "TextMagic contacts",
+			body: `{"page":1,"resources":[{"id":42,"firstName":"Doris","lastName":"Rodríguez","phone":"447700900123","email":"doris@example.com"}]}`,
+			want: `{"page":1,"resources":[{"email":"REDACTED","firstName":"REDACTED","id":42,"lastName":"REDACTED","phone":"REDACTED"}]}`,
+		},
+		{
+			name: "TextMagic message",
+			body: `{"text":"Hi Doris","phones":"447700900123","sendingDateTime":"2023-11-04 19:00:00"}`,
+			want: `{"phones":"REDACTED","sendingDateTime":"2023-11-04 19:00:00","text":"REDACTED"}`,
+		},
+		{
+			name: "not JSON",
+			body: "phone=447700900123&text=Hi+Doris",
+			want: "(text/plain; charset=utf-8, not shown)",
+		},
+		{
+			name:  "cut short",
+			body:  `{"id":42,"lists":"7,9,11"}`,
+			want:  `{"id":42,"li...`,
+			limit: 12,
+		},
+		{name: "empty"},
+	}
+	for _, test := range tests {
+		transport := &debugTransport{bodyLimit: test.limit}
+		if got := transport.redactBody([]byte(test.body)); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+// debugLog captures what's logged at debug level until the test ends.
+func debugLog(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return &buf
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestDebugTransport(t *testing.T) {
+	log := debugLog(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != `{"firstName":"Doris","phone":"447700900123"}` {
+			t.Errorf("server got %s", body)
+		}
+		w.Header().Set("Set-Cookie", "session=secret")
+		w.Write([]byte(`{"id":42,"firstName":"Doris"}`))
+	}))
+	defer server.Close()
+	client := &http.Client{Transport: &debugTransport{api: "textmagic", bodyLimit: 2000, next: http.DefaultTransport}}
+
+	r, _ := http.NewRequest("PUT", server.URL+"/api/v2/contacts/phone/447700900123?query=Doris",
+		strings.NewReader(`{"firstName":"Doris","phone":"447700900123"}`))
+	r.Header.Set("X-TM-Key", "tm-secret")
+	resp, err := client.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != `{"id":42,"firstName":"Doris"}` {
+		t.Errorf("caller got %s", body)
+	}
+
+	logged := log.String()
+	for _, secret := range []string{"tm-secret", "Doris", "447700900123", "session=secret"} {
+		if strings.Contains(logged, secret) {
+			t.Errorf("logged %q:\n%s", secret, logged)
+		}
+	}
+	if !strings.Contains(logged, "status=200") {
+		t.Errorf("didn't log the response:\n%s", logged)
+	}
+}
+
+// A request that never gets a response is logged without one.
+func TestDebugTransportFailure(t *testing.T) {
+	log := debugLog(t)
+	refused := errors.New("connection refused")
+	transport := &debugTransport{api: "uplisting", next: roundTripperFunc(func(*http.Request) (*http.Response, error) {
+		return nil, refused
+	})}
+
+	r := httptest.NewRequest("GET", "https://connect.uplisting.io/properties", nil)
+	r.Header.Set("Authorization", "Basic a2V5Og==")
+	resp, err := transport.RoundTrip(r)
+	if resp != nil || !errors.Is(err, refused) {
+		t.Errorf("got %v, %v, want just the error", resp, err)
+	}
+	logged := log.String()
+	if !strings.Contains(logged, "HTTP request failed") || !strings.Contains(logged, "connection refused") {
+		t.Errorf("didn't log the failure:\n%s", logged)
+	}
+	if strings.Contains(logged, "a2V5Og") {
+		t.Errorf("logged the credentials:\n%s", logged)
+	}
+}
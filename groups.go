@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/matthewbloch/text-guests/textmagic"
+	"github.com/matthewbloch/text-guests/uplisting"
+)
+
+/* Properties can be put into groups, e.g. one per brand, each with its own
+ * templates and sender:
+ *
+ *   PROPERTY_GROUPS=york.holiday:YORK,Headingley House:LEEDS
+ *
+ * matches properties by Uplisting ID, name, nickname or domain. A group's
+ * templates are TEMPLATE_LEEDS_RECENT and so on (or TextMagic templates
+ * "Rebook: LEEDS_RECENT"), and its sender is TEXTMAGIC_FROM_LEEDS (or LEEDS
+ * under senders: in the config file). Groups can also be set out in the
+ * config file, with their properties, templates and sender together.
+ * Anything a group doesn't have falls back to the defaults.
+ */
+
+// templateSet is the templates and sender for one group of properties; the
+// default group is "".
+type templateSet struct {
+	templates map[string]*template.Template
+	from      string
+}
+
+// parsePropertyGroups reads PROPERTY_GROUPS into a map from property ID,
+// name, nickname or domain to group, and the names of the groups in the order
+// they're first mentioned.
+func parsePropertyGroups(entries []string) (groups map[string]string, names []string, err error) {
+	groups = make(map[string]string)
+	for _, entry := range entries {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		at := strings.LastIndex(entry, ":")
+		if at < 0 {
+			return nil, nil, fmt.Errorf("PROPERTY_GROUPS: %q should be property:GROUP", entry)
+		}
+		property, group := strings.TrimSpace(entry[:at]), strings.ToUpper(strings.TrimSpace(entry[at+1:]))
+		if property == "" || group == "" {
+			return nil, nil, fmt.Errorf("PROPERTY_GROUPS: %q should be property:GROUP", entry)
+		}
+		groups[property] = group
+		names = appendUnique(names, group)
+	}
+	return groups, names, nil
+}
+
+// propertyGroups is the groups from the config file, then PROPERTY_GROUPS,
+// which can move properties between them.
+func (c config) propertyGroups() (groups map[string]string, names []string, err error) {
+	groups = make(map[string]string)
+	for _, group := range c.Groups {
+		name := strings.ToUpper(strings.TrimSpace(group.Name))
+		for _, property := range group.Properties {
+			groups[strings.TrimSpace(property)] = name
+		}
+		names = appendUnique(names, name)
+	}
+	envGroups, envNames, err := parsePropertyGroups(c.PropertyGroups)
+	if err != nil {
+		return nil, nil, err
+	}
+	for property, group := range envGroups {
+		groups[property] = group
+	}
+	for _, name := range envNames {
+		names = appendUnique(names, name)
+	}
+	return groups, names, nil
+}
+
+// groupConfig is the config file's settings for a group, if it has any.
+func (c config) groupConfig(group string) groupConfig {
+	for _, g := range c.Groups {
+		if strings.EqualFold(strings.TrimSpace(g.Name), group) {
+			return g
+		}
+	}
+	return groupConfig{}
+}
+
+// groupSender is who a group's texts come from.
+func (c config) groupSender(group string) string {
+	if from := c.groupConfig(group).From; from != "" {
+		return from
+	}
+	if from := c.Senders[group]; from != "" {
+		return from
+	}
+	return c.TextMagicFrom
+}
+
+// propertyGroups maps each property's name, as it appears on bookings, to its
+// group. An exact match on ID wins over name, then nickname, then domain.
+func propertyGroups(groups map[string]string, properties []uplisting.Property) map[string]string {
+	byName := make(map[string]string)
+	for _, p := range properties {
+		for _, key := range []string{p.ID, p.Name, p.Nickname, p.UplistingDomain} {
+			if group, ok := groups[key]; ok && key != "" {
+				byName[p.Name] = group
+				break
+			}
+		}
+	}
+	return byName
+}
+
+// loadTemplateSets fetches and parses the default templates, and every
+// group's, filling gaps in a group from the defaults. If any are wrong, the
+// error is a templateErrors listing every problem.
+func loadTemplateSets(c config, client *textmagic.Client, variants map[string][]templateVariant, groups []string) (map[string]templateSet, error) {
+	names := c.allTemplateNames(variants)
+	var fromTextMagic map[string]string
+	if c.TemplateSource == "textmagic" {
+		var err error
+		if fromTextMagic, err = textMagicTemplates(client); err != nil {
+			return nil, err
+		}
+	}
+	defaults, err := templateTexts(c, fromTextMagic, names)
+	if err != nil {
+		return nil, err
+	}
+	sets := make(map[string]templateSet)
+	templates, problems := parseTemplates(defaults)
+	sets[""] = templateSet{templates, c.TextMagicFrom}
+	defaultProblems := make(map[string]bool)
+	for _, problem := range problems {
+		defaultProblems[problem] = true
+	}
+
+	for _, group := range groups {
+		texts := make(map[string]string)
+		for name, text := range defaults {
+			texts[name] = text
+		}
+		for _, name := range names {
+			if text := groupTemplateText(c, fromTextMagic, group, name); text != "" {
+				texts[name] = text
+			}
+		}
+		templates, groupProblems := parseTemplates(texts)
+		for _, problem := range groupProblems {
+			// Gaps the group filled from the defaults are already reported
+			if !defaultProblems[problem] {
+				problems = append(problems, "group "+group+": "+problem)
+			}
+		}
+		sets[group] = templateSet{templates, c.groupSender(group)}
+	}
+	if len(problems) > 0 {
+		return nil, problems
+	}
+	return sets, nil
+}
+
+// groupTemplateText is a group's own text for a template, or "" if it
+// doesn't have one.
+func groupTemplateText(c config, fromTextMagic map[string]string, group, name string) string {
+	if c.TemplateSource != "textmagic" {
+		return c.groupTemplate(group, name)
+	}
+	return fromTextMagic[c.TextMagicTemplatePrefix+group+"_"+name]
+}
+
+// groupTemplate is a group's own text for a template from the config, or ""
+// if it doesn't have one.
+func (c config) groupTemplate(group, name string) string {
+	if text := c.groupConfig(group).Templates[name]; text != "" {
+		return text
+	}
+	return c.Templates[group+"_"+name]
+}
+
+// templateSet is the set for the property the guest last stayed at.
+func (s state) templateSet(g *guest) templateSet {
+	if set, ok := s.templateSets[s.propertyGroups[g.lastStay().PropertyName]]; ok {
+		return set
+	}
+	return s.templateSets[""]
+}
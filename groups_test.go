@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/matthewbloch/text-guests/textmagic"
+	"github.com/matthewbloch/text-guests/uplisting"
+)
+
+func TestPropertyGroups(t *testing.T) {
+	groups := map[string]string{
+		"7458":         "YORK",
+		"Agar Street":  "LEEDS", // the ID beats this
+		"Headingley":   "LEEDS",
+		"york.holiday": "YORK",
+		"Leeds Loft":   "LEEDS",
+		"":             "NOBODY",
+	}
+	properties := []uplisting.Property{
+		{ID: "7458", Name: "Agar Street"},
+		{ID: "7459", Name: "Headingley House", Nickname: "Headingley", UplistingDomain: "york.holiday"},
+		{ID: "7460", Name: "Bootham Row", UplistingDomain: "york.holiday"},
+		{ID: "7461", Name: "Leeds Loft", Nickname: "Loft"},
+		{ID: "7462", Name: "Gillygate"},
+	}
+	want := map[string]string{
+		"Agar Street":      "YORK",
+		"Headingley House": "LEEDS",
+		"Bootham Row":      "YORK",
+		"Leeds Loft":       "LEEDS",
+	}
+	if got := propertyGroups(groups, properties); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// PROPERTY_GROUPS adds to the config file's groups, and can move a
+// property out of one.
+func TestConfigPropertyGroups(t *testing.T) {
+	c := validConfig()
+	c.Groups = []groupConfig{
+		{Name: "leeds", Properties: []string{"Headingley House", " Agar Street "}},
+	}
+	c.PropertyGroups = []string{"Agar Street:york", " york.holiday : YORK ", "", "Hull Loft:hull"}
+	groups, names, err := c.propertyGroups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantGroups := map[string]string{
+		"Headingley House": "LEEDS",
+		"Agar Street":      "YORK",
+		"york.holiday":     "YORK",
+		"Hull Loft":        "HULL",
+	}
+	if !reflect.DeepEqual(groups, wantGroups) || !reflect.DeepEqual(names, []string{"LEEDS", "YORK", "HULL"}) {
+		t.Errorf("got %v %v", groups, names)
+	}
+
+	for _, entry := range []string{"Agar Street", "Agar Street:", ":YORK"} {
+		c.PropertyGroups = []string{entry}
+		if _, _, err := c.propertyGroups(); err == nil {
+			t.Errorf("accepted %q", entry)
+		}
+	}
+}
+
+// templateText is the text a template was parsed from.
+func templateText(set templateSet, name string) string {
+	if t := set.templates[name]; t != nil {
+		return t.Tree.Root.String()
+	}
+	return ""
+}
+
+func TestLoadTemplateSets(t *testing.T) {
+	c := validConfig()
+	c.TextMagicFrom = "YorkHoliday"
+	c.Templates["RECENT_B"] = "Thanks again"
+	c.Templates["LEEDS_RECENT"] = "Thanks for staying in Leeds"
+	c.Senders = map[string]string{"HULL": "HullStays"}
+	c.Groups = []groupConfig{{Name: "Leeds", From: "Headingley", Templates: map[string]string{"OLD": "Come back to Leeds"}}}
+	variants, err := parseTemplateVariants([]string{"RECENT:1", "RECENT_B:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sets, err := loadTemplateSets(c, nil, variants, []string{"LEEDS", "HULL"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		group, name, want string
+	}{
+		{"", "RECENT", "Thanks, {{.FirstName}}"},
+		{"", "RECENT_B", "Thanks again"},
+		{"LEEDS", "OLD", "Come back to Leeds"},
+		{"LEEDS", "RECENT", "Thanks for staying in Leeds"},
+		// Gaps are filled from the defaults
+		{"LEEDS", "RECENT_B", "Thanks again"},
+		{"LEEDS", "DIRECT", "Thanks for booking direct, {{.FirstName}}"},
+		{"HULL", "OLD", "Come back, {{.FirstName}}"},
+	}
+	for _, test := range tests {
+		if got := templateText(sets[test.group], test.name); got != test.want {
+			t.Errorf("%q %s = %q, want %q", test.group, test.name, got, test.want)
+		}
+	}
+	senders := map[string]string{"": "YorkHoliday", "LEEDS": "Headingley", "HULL": "HullStays"}
+	for group, want := range senders {
+		if got := sets[group].from; got != want {
+			t.Errorf("%q is from %q, want %q", group, got, want)
+		}
+	}
+
+	// A group's own mistakes are reported against it, but gaps aren't
+	// reported again for every group.
+	c.Templates["LEEDS_DIRECT"] = "Thanks {{.FirstName"
+	delete(c.Templates, "OLD")
+	_, err = loadTemplateSets(c, nil, variants, []string{"LEEDS", "HULL"})
+	want := templateErrors{
+		"template OLD is empty",
+		`group LEEDS: template: DIRECT:1: unclosed action`,
+	}
+	if got, _ := err.(templateErrors); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", err, want)
+	}
+}
+
+// TextMagic's templates are fetched once, however many groups and
+// languages need them.
+func TestLoadTemplateSetsFromTextMagic(t *testing.T) {
+	pages := [][]textmagic.Template{
+		{
+			{Id: 1, Name: "Rebook: OLD", Content: "Come back"},
+			{Id: 2, Name: "Rebook: RECENT", Content: "Thanks"},
+			{Id: 3, Name: "Rebook: LEEDS_RECENT", Content: "Thanks for staying in Leeds"},
+		},
+		{
+			{Id: 4, Name: "Rebook: DIRECT", Content: "Thanks for booking direct"},
+			{Id: 5, Name: "Rebook: OLD_fr", Content: "Revenez"},
+			{Id: 6, Name: "Rebook: RECENT_fr", Content: "Merci"},
+			{Id: 7, Name: "Rebook: DIRECT_fr", Content: "Merci d'avoir réservé en direct"},
+			{Id: 8, Name: "Rebook: OLD", Content: "An older copy"},
+		},
+	}
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v2/templates" {
+			http.NotFound(w, r)
+			return
+		}
+		requests++
+		page := 1
+		if r.URL.Query().Get("page") == "2" {
+			page = 2
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(textmagic.Page[textmagic.Template]{Page: page, PageCount: len(pages), Limit: 100, Resources: pages[page-1]})
+	}))
+	defer server.Close()
+	client := &textmagic.Client{Http: server.Client(), Base: server.URL}
+
+	c := validConfig()
+	c.TemplateSource = "textmagic"
+	c.Locales = []string{"fr"}
+	sets, err := loadTemplateSets(c, client, nil, []string{"LEEDS", "HULL", "YORK"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests != len(pages) {
+		t.Errorf("fetched %d pages of templates, want each of %d once", requests, len(pages))
+	}
+	tests := []struct {
+		group, name, want string
+	}{
+		{"", "OLD", "Come back"},
+		{"", "DIRECT_fr", "Merci d'avoir réservé en direct"},
+		{"LEEDS", "RECENT", "Thanks for staying in Leeds"},
+		{"LEEDS", "RECENT_fr", "Merci"},
+		{"YORK", "RECENT", "Thanks"},
+	}
+	for _, test := range tests {
+		if got := templateText(sets[test.group], test.name); got != test.want {
+			t.Errorf("%q %s = %q, want %q", test.group, test.name, got, test.want)
+		}
+	}
+
+	c.Locales = []string{"de"}
+	if _, err := loadTemplateSets(c, client, nil, nil); !errors.Is(err, textmagic.ErrNotFound) {
+		t.Errorf("got %v, want the missing German templates not found", err)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/matthewbloch/text-guests/textmagic"
+	"github.com/matthewbloch/text-guests/uplisting"
+)
+
+// guest is everything we know about one person: their TextMagic contact and
+// every stay we've found for them in Uplisting.
+type guest struct {
+	identity *identity
+	contact  textmagic.Contact
+
+	// Ordered by departure, oldest first.
+	stays        []uplisting.Booking
+	totalNights  int
+	totalRevenue float64
+	channels     []string
+}
+
+func newGuest(id *identity) *guest {
+	g := &guest{identity: id}
+	for _, booking := range id.bookings {
+		g.addStay(booking)
+	}
+	return g
+}
+
+// addStay records a booking against the guest, ignoring any we've already
+// seen.
+func (g *guest) addStay(b uplisting.Booking) {
+	for _, stay := range g.stays {
+		if stay.ID == b.ID {
+			return
+		}
+	}
+	g.stays = append(g.stays, b)
+	sort.SliceStable(g.stays, func(i, j int) bool {
+		return g.stays[i].DepartureAt().Before(g.stays[j].DepartureAt())
+	})
+	g.totalNights += b.NumberOfNights
+	g.totalRevenue += b.TotalPayout
+	g.channels = appendUnique(g.channels, string(b.Channel))
+}
+
+func (g *guest) firstStay() uplisting.Booking {
+	if len(g.stays) == 0 {
+		return uplisting.Booking{}
+	}
+	return g.stays[0]
+}
+
+func (g *guest) lastStay() uplisting.Booking {
+	if len(g.stays) == 0 {
+		return uplisting.Booking{}
+	}
+	return g.stays[len(g.stays)-1]
+}
+
+// phone is the number the guest gave us most recently.
+func (g *guest) phone() string {
+	for i := len(g.stays) - 1; i >= 0; i-- {
+		if g.stays[i].GuestPhone != "" {
+			return g.stays[i].GuestPhone
+		}
+	}
+	return ""
+}
+
+// firstName prefers whatever's on the TextMagic contact, and falls back to
+// the most recent booking.
+func (g *guest) firstName() string {
+	if name := strings.TrimSpace(g.contact.FirstName); name != "" {
+		return name
+	}
+	first, _ := contactName(g.lastStay())
+	return first
+}
+
+func splitGuestName(name string) (first, last string) {
+	names := strings.SplitN(strings.TrimSpace(name), " ", 2)
+	first = names[0]
+	if len(names) > 1 {
+		last = strings.TrimSpace(names[1])
+	}
+	return first, last
+}
+
+// contactName is the name a booking gives us for the guest's contact: the
+// one they'd rather go by, if they've told Uplisting. Booking.com gives us
+// "Surname Forename" otherwise, which we can't safely split, so we leave
+// those alone.
+func contactName(b uplisting.Booking) (first, last string) {
+	if name := strings.TrimSpace(b.PreferredGuestName); name != "" {
+		return splitGuestName(name)
+	}
+	if b.Channel == uplisting.ChannelBookingDotCom {
+		return "", ""
+	}
+	return splitGuestName(b.GuestName)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/matthewbloch/text-guests/uplisting"
+)
+
+// stay is a booking checking out on checkOut, with just enough filled in for
+// the guest record.
+func stay(id int, checkOut string, nights int, payout float64, channel uplisting.Channel) uplisting.Booking {
+	return uplisting.Booking{
+		ID:             id,
+		CheckOut:       checkOut,
+		DepartureTime:  "11:00:00",
+		NumberOfNights: nights,
+		TotalPayout:    payout,
+		Channel:        channel,
+		GuestPhone:     "+447700900123",
+		GuestName:      "Doris Rodríguez",
+	}
+}
+
+func TestGuestAddStay(t *testing.T) {
+	tests := []struct {
+		name     string
+		stays    []uplisting.Booking
+		ids      []int
+		first    int
+		last     int
+		nights   int
+		revenue  float64
+		channels []string
+	}{
+		{
+			name: "none",
+		},
+		{
+			name:     "one",
+			stays:    []uplisting.Booking{stay(1, "2023-11-04", 5, 526.34, uplisting.ChannelBookingDotCom)},
+			ids:      []int{1},
+			first:    1,
+			last:     1,
+			nights:   5,
+			revenue:  526.34,
+			channels: []string{"booking_dot_com"},
+		},
+		{
+			name: "out of order",
+			stays: []uplisting.Booking{
+				stay(2, "2023-11-04", 5, 500, uplisting.ChannelAirbnb),
+				stay(1, "2022-06-10", 2, 200, uplisting.ChannelUplisting),
+				stay(3, "2023-12-01", 3, 300, uplisting.ChannelAirbnb),
+			},
+			ids:      []int{1, 2, 3},
+			first:    1,
+			last:     3,
+			nights:   10,
+			revenue:  1000,
+			channels: []string{"airbnb", "uplisting"},
+		},
+		{
+			name: "same booking twice",
+			stays: []uplisting.Booking{
+				stay(1, "2023-11-04", 5, 500, uplisting.ChannelAirbnb),
+				stay(1, "2023-11-04", 5, 500, uplisting.ChannelAirbnb),
+			},
+			ids:      []int{1},
+			first:    1,
+			last:     1,
+			nights:   5,
+			revenue:  500,
+			channels: []string{"airbnb"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := newGuest(&identity{bookings: test.stays})
+			var ids []int
+			for _, s := range g.stays {
+				ids = append(ids, s.ID)
+			}
+			if !reflect.DeepEqual(ids, test.ids) {
+				t.Errorf("stays = %v, want %v", ids, test.ids)
+			}
+			if got := g.firstStay().ID; got != test.first {
+				t.Errorf("firstStay = %d, want %d", got, test.first)
+			}
+			if got := g.lastStay().ID; got != test.last {
+				t.Errorf("lastStay = %d, want %d", got, test.last)
+			}
+			if g.totalNights != test.nights {
+				t.Errorf("totalNights = %d, want %d", g.totalNights, test.nights)
+			}
+			if g.totalRevenue != test.revenue {
+				t.Errorf("totalRevenue = %.2f, want %.2f", g.totalRevenue, test.revenue)
+			}
+			if !reflect.DeepEqual(g.channels, test.channels) {
+				t.Errorf("channels = %v, want %v", g.channels, test.channels)
+			}
+		})
+	}
+}
+
+func TestSplitGuestName(t *testing.T) {
+	tests := []struct {
+		name, first, last string
+	}{
+		{"Doris Rodríguez", "Doris", "Rodríguez"},
+		{"  Doris  ", "Doris", ""},
+		{"Mary Anne Smith", "Mary", "Anne Smith"},
+		{"", "", ""},
+	}
+	for _, test := range tests {
+		first, last := splitGuestName(test.name)
+		if first != test.first || last != test.last {
+			t.Errorf("splitGuestName(%q) = %q, %q, want %q, %q", test.name, first, last, test.first, test.last)
+		}
+	}
+}
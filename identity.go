@@ -0,0 +1,301 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"unicode"
+
+	"github.com/ttacon/libphonenumber"
+
+	"github.com/matthewbloch/text-guests/uplisting"
+)
+
+// OTAs hand out a forwarding address per booking, so these tell us nothing
+// about who the guest is and must never be used to join bookings together.
+var relayEmailDomains = []string{
+	"guest.booking.com",
+	"guest.airbnb.com",
+	"messages.homeaway.com",
+}
+
+const (
+	phoneConfidence = 1.0
+	emailConfidence = 0.95
+	// A name match on its own is scaled by this, so an identical name scores
+	// below the default merge threshold and gets reported rather than merged.
+	nameConfidence = 0.8
+	// Below this we don't even mention two names as a possible match.
+	minNameSimilarity = 0.5
+)
+
+/* We try to use a phone number to identify guests, but the format can be a bit
+ * loose. For now let's use libphonenumber to try to normalize it, but that feels
+ * like an intrusive default to put inside our API client.
+ */
+func normalizePhone(phone string) string {
+	toParse := phone
+	if !strings.HasPrefix(toParse, "0") {
+		toParse = "+" + toParse
+	}
+	normalized, err := libphonenumber.Parse(toParse, "GB")
+	if err != nil {
+		return phone
+	}
+	return libphonenumber.Format(normalized, libphonenumber.E164)
+}
+
+// realEmail returns the lower-cased email address, or "" if it's empty or one
+// of the OTA relay addresses.
+func realEmail(email string) string {
+	email = strings.ToLower(strings.TrimSpace(email))
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return ""
+	}
+	domain := email[at+1:]
+	for _, relay := range relayEmailDomains {
+		if domain == relay || strings.HasSuffix(domain, "."+relay) {
+			return ""
+		}
+	}
+	return email
+}
+
+var accentFolder = strings.NewReplacer(
+	"á", "a", "à", "a", "â", "a", "ä", "a", "ã", "a", "å", "a",
+	"é", "e", "è", "e", "ê", "e", "ë", "e",
+	"í", "i", "ì", "i", "î", "i", "ï", "i",
+	"ó", "o", "ò", "o", "ô", "o", "ö", "o", "õ", "o", "ø", "o",
+	"ú", "u", "ù", "u", "û", "u", "ü", "u",
+	"ñ", "n", "ç", "c", "ý", "y", "ÿ", "y", "ß", "ss",
+)
+
+// nameTokens splits a name into lower-case, accent-folded words. Booking.com
+// gives us "Surname Forename" where others give "Forename Surname", so we only
+// ever compare the words as a set.
+func nameTokens(name string) map[string]bool {
+	folded := accentFolder.Replace(strings.ToLower(name))
+	tokens := make(map[string]bool)
+	for _, word := range strings.FieldsFunc(folded, func(r rune) bool { return !unicode.IsLetter(r) }) {
+		if len(word) > 1 {
+			tokens[word] = true
+		}
+	}
+	return tokens
+}
+
+// nameSimilarity is the Jaccard index of the two names' words.
+func nameSimilarity(a, b string) float64 {
+	ta, tb := nameTokens(a), nameTokens(b)
+	if len(ta) == 0 || len(tb) == 0 {
+		return 0
+	}
+	shared := 0
+	for word := range ta {
+		if tb[word] {
+			shared++
+		}
+	}
+	return float64(shared) / float64(len(ta)+len(tb)-shared)
+}
+
+// identity is our best guess at one real person, and every booking they've
+// made under whatever phone numbers, emails and spellings of their name.
+type identity struct {
+	bookings []uplisting.Booking
+	phones   []string
+	emails   []string
+	names    []string
+	// The weakest link we relied on to join these bookings together.
+	confidence float64
+	matchedBy  []string
+}
+
+// possibleMatch is a pair of identities which look alike, but not enough to
+// merge at the configured confidence.
+type possibleMatch struct {
+	a, b       *identity
+	confidence float64
+	reason     string
+}
+
+type identityLink struct {
+	a, b       int
+	confidence float64
+	reason     string
+}
+
+func appendUnique(list []string, s string) []string {
+	if s == "" {
+		return list
+	}
+	for _, existing := range list {
+		if existing == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
+
+// resolveIdentities groups bookings by the people who made them. Bookings are
+// joined when they share a phone number or a real email address, or have
+// similar names, as long as the confidence of that link is at least
+// minConfidence. Links which fall short of that are returned as possible
+// matches, for a human to look at.
+func resolveIdentities(bookings []uplisting.Booking, minConfidence float64) ([]*identity, []possibleMatch) {
+	parent := make([]int, len(bookings))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	links := make(map[int][]identityLink)
+	union := func(link identityLink) {
+		ra, rb := find(link.a), find(link.b)
+		if ra == rb {
+			return
+		}
+		if rb < ra {
+			ra, rb = rb, ra
+		}
+		parent[rb] = ra
+		links[ra] = append(links[ra], links[rb]...)
+		links[ra] = append(links[ra], link)
+		delete(links, rb)
+	}
+
+	var weakLinks []identityLink
+	join := func(link identityLink) {
+		if link.confidence >= minConfidence {
+			union(link)
+		} else {
+			weakLinks = append(weakLinks, link)
+		}
+	}
+
+	byPhone := make(map[string]int)
+	byEmail := make(map[string]int)
+	for i, booking := range bookings {
+		if phone := booking.GuestPhone; phone != "" {
+			if first, ok := byPhone[phone]; ok {
+				join(identityLink{first, i, phoneConfidence, "phone"})
+			} else {
+				byPhone[phone] = i
+			}
+		}
+		if email := realEmail(booking.GuestEmail); email != "" {
+			if first, ok := byEmail[email]; ok {
+				join(identityLink{first, i, emailConfidence, "email"})
+			} else {
+				byEmail[email] = i
+			}
+		}
+	}
+
+	/* Names are compared between the groups we've already found, taking the
+	 * closest pair of names between each group.
+	 */
+	type nameLink struct {
+		identityLink
+		similarity float64
+	}
+	var nameLinks []nameLink
+	for i := range bookings {
+		for j := i + 1; j < len(bookings); j++ {
+			if find(i) == find(j) {
+				continue
+			}
+			similarity := nameSimilarity(bookings[i].GuestName, bookings[j].GuestName)
+			if similarity < minNameSimilarity {
+				continue
+			}
+			nameLinks = append(nameLinks, nameLink{identityLink{i, j, nameConfidence * similarity, "name"}, similarity})
+		}
+	}
+	sort.SliceStable(nameLinks, func(i, j int) bool { return nameLinks[i].confidence > nameLinks[j].confidence })
+
+	for _, link := range nameLinks {
+		join(link.identityLink)
+	}
+
+	var identities []*identity
+	byRoot := make(map[int]*identity)
+	for i, booking := range bookings {
+		root := find(i)
+		id, ok := byRoot[root]
+		if !ok {
+			id = &identity{confidence: 1}
+			for _, link := range links[root] {
+				if link.confidence < id.confidence {
+					id.confidence = link.confidence
+				}
+				id.matchedBy = appendUnique(id.matchedBy, link.reason)
+			}
+			byRoot[root] = id
+			identities = append(identities, id)
+		}
+		id.bookings = append(id.bookings, booking)
+		id.phones = appendUnique(id.phones, booking.GuestPhone)
+		id.emails = appendUnique(id.emails, strings.ToLower(strings.TrimSpace(booking.GuestEmail)))
+		id.names = appendUnique(id.names, strings.TrimSpace(booking.GuestName))
+	}
+
+	var possible []possibleMatch
+	reported := make(map[[2]int]bool)
+	for _, link := range weakLinks {
+		ra, rb := find(link.a), find(link.b)
+		if ra == rb || reported[[2]int{ra, rb}] {
+			continue
+		}
+		reported[[2]int{ra, rb}] = true
+		reported[[2]int{rb, ra}] = true
+		possible = append(possible, possibleMatch{byRoot[ra], byRoot[rb], link.confidence, link.reason})
+	}
+
+	return identities, possible
+}
+
+func (id *identity) describe() string {
+	return fmt.Sprintf("%s (%s)", strings.Join(id.names, " / "), strings.Join(id.phones, ", "))
+}
+
+// writeIdentityReport shows every identity that was merged from more than one
+// phone number, email address or name, then any possible matches.
+func writeIdentityReport(w io.Writer, identities []*identity, possible []possibleMatch) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CONFIDENCE\tBOOKINGS\tNAMES\tPHONES\tEMAILS\tMATCHED BY")
+	merged := 0
+	for _, id := range identities {
+		if len(id.phones) < 2 && len(id.emails) < 2 && len(id.names) < 2 {
+			continue
+		}
+		merged++
+		fmt.Fprintf(tw, "%.2f\t%d\t%s\t%s\t%s\t%s\n",
+			id.confidence, len(id.bookings),
+			strings.Join(id.names, " / "), strings.Join(id.phones, ", "),
+			strings.Join(id.emails, ", "), strings.Join(id.matchedBy, ", "))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "\n%d identities, %d merged from differing details\n", len(identities), merged)
+
+	if len(possible) == 0 {
+		return nil
+	}
+	fmt.Fprintf(w, "\nPossible matches, not merged:\n")
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CONFIDENCE\tREASON\tGUEST\tGUEST")
+	for _, match := range possible {
+		fmt.Fprintf(tw, "%.2f\t%s\t%s\t%s\n", match.confidence, match.reason, match.a.describe(), match.b.describe())
+	}
+	return tw.Flush()
+}
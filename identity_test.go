@@ -0,0 +1,152 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/matthewbloch/text-guests/uplisting"
+)
+
+func TestRealEmail(t *testing.T) {
+	for email, want := range map[string]string{
+		" Doris@Example.com ":               "doris@example.com",
+		"doris.8hj2k@guest.booking.com":     "",
+		"doris-x1@guest.airbnb.com":         "",
+		"doris@eu.guest.booking.com":        "",
+		"abc123@messages.homeaway.com":      "",
+		"doris@notguest.booking.com.evil.x": "doris@notguest.booking.com.evil.x",
+		"not an address":                    "",
+		"":                                  "",
+	} {
+		if got := realEmail(email); got != want {
+			t.Errorf("realEmail(%q) = %q, want %q", email, got, want)
+		}
+	}
+}
+
+func TestNameSimilarity(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want float64
+	}{
+		{"Doris Rodríguez", "Doris Rodriguez", 1},
+		{"Doris Rodríguez", "RODRIGUEZ, Doris", 1},
+		{"Doris Rodríguez", "Doris Smith", 1.0 / 3},
+		{"Doris Ana Rodríguez", "Doris Rodríguez", 2.0 / 3},
+		{"Doris Rodríguez", "Ahmed Khan", 0},
+		{"D. R.", "Doris Rodríguez", 0},
+	}
+	for _, test := range tests {
+		if got := nameSimilarity(test.a, test.b); got != test.want {
+			t.Errorf("nameSimilarity(%q, %q) = %v, want %v", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+// guestBooking is a booking made under the given details.
+func guestBooking(id int, name, phone, email string) uplisting.Booking {
+	b := stay(id, "2023-11-04", 2, 200, uplisting.ChannelAirbnb)
+	b.GuestName, b.GuestPhone, b.GuestEmail = name, phone, email
+	return b
+}
+
+func TestResolveIdentities(t *testing.T) {
+	bookings := []uplisting.Booking{
+		guestBooking(1, "Doris Rodríguez", "+447700900001", "doris@example.com"),
+		// Same email, new phone
+		guestBooking(2, "Doris Rodríguez", "+447700900002", "Doris@Example.com"),
+		// Booking.com's name order and relay address
+		guestBooking(3, "Rodriguez Doris", "+447700900003", "doris.1@guest.booking.com"),
+		// Same relay address as someone else, which means nothing
+		guestBooking(4, "Ahmed Khan", "+447700900004", "doris.1@guest.booking.com"),
+		// Same phone as the first, whatever name they gave
+		guestBooking(5, "Dee", "+447700900001", ""),
+	}
+
+	type match struct {
+		a, b       []int
+		confidence float64
+		reason     string
+	}
+	tests := []struct {
+		name          string
+		minConfidence float64
+		identities    [][]int
+		confidence    []float64
+		matchedBy     [][]string
+		possible      []match
+	}{
+		{
+			name:          "default",
+			minConfidence: 0.9,
+			identities:    [][]int{{1, 2, 5}, {3}, {4}},
+			confidence:    []float64{0.95, 1, 1},
+			matchedBy:     [][]string{{"email", "phone"}, nil, nil},
+			possible:      []match{{[]int{1, 2, 5}, []int{3}, 0.8, "name"}},
+		},
+		{
+			// Emails fall short, so are only reported
+			name:          "phones only",
+			minConfidence: 0.99,
+			identities:    [][]int{{1, 5}, {2}, {3}, {4}},
+			confidence:    []float64{1, 1, 1, 1},
+			matchedBy:     [][]string{{"phone"}, nil, nil, nil},
+			possible: []match{
+				{[]int{1, 5}, []int{2}, 0.95, "email"},
+				{[]int{1, 5}, []int{3}, 0.8, "name"},
+				{[]int{2}, []int{3}, 0.8, "name"},
+			},
+		},
+		{
+			name:          "names too",
+			minConfidence: 0.75,
+			identities:    [][]int{{1, 2, 3, 5}, {4}},
+			confidence:    []float64{0.8, 1},
+			matchedBy:     [][]string{{"email", "phone", "name"}, nil},
+		},
+	}
+	ids := func(id *identity) (ids []int) {
+		for _, b := range id.bookings {
+			ids = append(ids, b.ID)
+		}
+		return ids
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			identities, possible := resolveIdentities(bookings, test.minConfidence)
+			if len(identities) != len(test.identities) {
+				t.Fatalf("got %d identities, want %d", len(identities), len(test.identities))
+			}
+			for i, id := range identities {
+				if got := ids(id); !reflect.DeepEqual(got, test.identities[i]) {
+					t.Errorf("identity %d has bookings %v, want %v", i, got, test.identities[i])
+				}
+				if id.confidence != test.confidence[i] || !reflect.DeepEqual(id.matchedBy, test.matchedBy[i]) {
+					t.Errorf("identity %d matched at %v by %v, want %v by %v", i, id.confidence, id.matchedBy, test.confidence[i], test.matchedBy[i])
+				}
+			}
+			if len(possible) != len(test.possible) {
+				t.Fatalf("got %d possible matches, want %d", len(possible), len(test.possible))
+			}
+			for i, p := range possible {
+				want := test.possible[i]
+				if !reflect.DeepEqual(ids(p.a), want.a) || !reflect.DeepEqual(ids(p.b), want.b) || p.confidence != want.confidence || p.reason != want.reason {
+					t.Errorf("possible match %d is %v and %v at %v by %s, want %v", i, ids(p.a), ids(p.b), p.confidence, p.reason, want)
+				}
+			}
+		})
+	}
+
+	// The merged guest has every detail they've given us
+	identities, _ := resolveIdentities(bookings, 0.9)
+	doris := identities[0]
+	if want := []string{"+447700900001", "+447700900002"}; !reflect.DeepEqual(doris.phones, want) {
+		t.Errorf("phones %v, want %v", doris.phones, want)
+	}
+	if want := []string{"doris@example.com"}; !reflect.DeepEqual(doris.emails, want) {
+		t.Errorf("emails %v, want %v", doris.emails, want)
+	}
+	if want := []string{"Doris Rodríguez", "Dee"}; !reflect.DeepEqual(doris.names, want) {
+		t.Errorf("names %v, want %v", doris.names, want)
+	}
+}
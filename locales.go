@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ttacon/libphonenumber"
+)
+
+/* Templates can be translated. The untranslated ones are in DEFAULT_LOCALE,
+ * and each other language in LOCALES has its own, with the language code
+ * after the name in lower case: TEMPLATE_RECENT_fr, or the TextMagic template
+ * "Rebook: RECENT_fr". Guests get the language of the country their phone
+ * number is from, unless their contact says otherwise.
+ */
+
+// The main language of the countries our guests are most likely to come
+// from. LOCALE_COUNTRIES can add to or override these.
+var countryLocales = map[string]string{
+	"GB": "en", "IE": "en", "US": "en", "CA": "en", "AU": "en", "NZ": "en", "ZA": "en",
+	"FR": "fr", "BE": "fr", "LU": "fr", "MC": "fr",
+	"DE": "de", "AT": "de", "CH": "de", "LI": "de",
+	"ES": "es", "MX": "es", "AR": "es", "CO": "es", "CL": "es", "PE": "es",
+	"IT": "it", "SM": "it",
+	"NL": "nl",
+	"PT": "pt", "BR": "pt",
+	"PL": "pl",
+	"SE": "sv", "NO": "no", "DK": "da", "FI": "fi",
+	"GR": "el", "TR": "tr", "RU": "ru",
+	"CN": "zh", "TW": "zh", "HK": "zh",
+	"JP": "ja", "KR": "ko",
+}
+
+// normalizeLocale turns "fr-FR", "FR" or " fr " into "fr".
+func normalizeLocale(locale string) string {
+	locale = strings.ToLower(strings.TrimSpace(locale))
+	locale, _, _ = strings.Cut(locale, "-")
+	locale, _, _ = strings.Cut(locale, "_")
+	return locale
+}
+
+// locales is every language we have templates in, the default first.
+func (c config) locales() []string {
+	locales := []string{normalizeLocale(c.DefaultLocale)}
+	for _, locale := range c.Locales {
+		locales = appendUnique(locales, normalizeLocale(locale))
+	}
+	return locales
+}
+
+// localeCountries is countryLocales with LOCALE_COUNTRIES applied.
+func (c config) localeCountries() (map[string]string, error) {
+	countries := make(map[string]string)
+	for country, locale := range countryLocales {
+		countries[country] = locale
+	}
+	for _, entry := range c.LocaleCountries {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		country, locale, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("LOCALE_COUNTRIES: %q should be COUNTRY:locale", entry)
+		}
+		countries[strings.ToUpper(strings.TrimSpace(country))] = normalizeLocale(locale)
+	}
+	return countries, nil
+}
+
+// localizedName is the name of a template in a language, e.g. RECENT_fr.
+func localizedName(name, locale, defaultLocale string) string {
+	if locale == "" || locale == defaultLocale {
+		return name
+	}
+	return name + "_" + locale
+}
+
+// allTemplateNames is every template we need text for: each variant of each
+// template, in each language.
+func (c config) allTemplateNames(variants map[string][]templateVariant) []string {
+	locales := c.locales()
+	var names []string
+	for _, name := range variantNames(variants) {
+		for _, locale := range locales {
+			names = append(names, localizedName(name, locale, locales[0]))
+		}
+	}
+	return names
+}
+
+// phoneCountry is the region code, e.g. "FR", for an E.164 phone number.
+func phoneCountry(phone string) string {
+	number, err := libphonenumber.Parse(phone, "GB")
+	if err != nil {
+		return ""
+	}
+	return libphonenumber.GetRegionCodeForNumber(number)
+}
+
+// guestLocale picks the language to text a guest in: whatever their contact's
+// locale field says, or the language of their phone number's country, as
+// long as we have templates in it.
+func (s state) guestLocale(g *guest) string {
+	have := func(locale string) bool {
+		for _, l := range s.locales {
+			if l == locale {
+				return true
+			}
+		}
+		return false
+	}
+	if s.localeField.Id != 0 {
+		if raw, ok := g.contact.CustomFieldValue(s.localeField.Id); ok {
+			if locale := normalizeLocale(raw); have(locale) {
+				return locale
+			}
+		}
+	}
+	if locale := s.localeCountries[phoneCountry(g.phone())]; have(locale) {
+		return locale
+	}
+	return s.locales[0]
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* A small registry which speaks Prometheus' text exposition format, which is
+ * all we need for a handful of counters and histograms.
+ */
+
+var (
+	metrics = &registry{}
+
+	apiRequests = metrics.counter("text_guests_api_requests_total",
+		"API requests made, by client, endpoint and HTTP status.", "client", "endpoint", "status")
+	apiLatency = metrics.histogram("text_guests_api_request_duration_seconds",
+		"How long API requests took, by client and endpoint.",
+		[]float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}, "client", "endpoint")
+	messagesSent = metrics.counter("text_guests_messages_sent_total",
+		"Messages sent to guests, by template.", "template")
+	skipsTotal = metrics.counter("text_guests_skipped_total",
+		"Guests we didn't text, by reason.", "reason")
+	optOuts = metrics.counter("text_guests_opt_outs_total",
+		"Guests who've asked us to stop texting them.")
+	errorsTotal = metrics.counter("text_guests_errors_total",
+		"Errors during runs, by category.", "category")
+	runsTotal = metrics.counter("text_guests_runs_total",
+		"Campaign runs, by tenant and result.", "tenant", "result")
+	lastRun = metrics.gauge("text_guests_last_run_timestamp_seconds",
+		"When the last campaign run finished, by tenant and result.", "tenant", "result")
+	webhooksTotal = metrics.counter("text_guests_webhooks_total",
+		"Webhooks received, by source and event.", "source", "event")
+)
+
+type registry struct {
+	mu      sync.Mutex
+	metrics []*metric
+}
+
+type metric struct {
+	name, help, kind string
+	labels           []string
+	buckets          []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	// Histograms only
+	bucketCounts []uint64
+	count        uint64
+}
+
+func (r *registry) add(m *metric) *metric {
+	m.series = make(map[string]*series)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+	return m
+}
+
+func (r *registry) counter(name, help string, labels ...string) *metric {
+	return r.add(&metric{name: name, help: help, kind: "counter", labels: labels})
+}
+
+func (r *registry) gauge(name, help string, labels ...string) *metric {
+	return r.add(&metric{name: name, help: help, kind: "gauge", labels: labels})
+}
+
+func (r *registry) histogram(name, help string, buckets []float64, labels ...string) *metric {
+	return r.add(&metric{name: name, help: help, kind: "histogram", labels: labels, buckets: buckets})
+}
+
+// with finds the series for the given label values, in the order the
+// labels were declared, creating it if need be. Call with m.mu held.
+func (m *metric) with(labelValues []string) *series {
+	if len(labelValues) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s wants %d labels, got %d", m.name, len(m.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\x00")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{labelValues: labelValues}
+		if m.kind == "histogram" {
+			s.bucketCounts = make([]uint64, len(m.buckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+func (m *metric) inc(labelValues ...string) {
+	m.add(1, labelValues...)
+}
+
+func (m *metric) add(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.with(labelValues).value += v
+}
+
+func (m *metric) set(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.with(labelValues).value = v
+}
+
+func (m *metric) observe(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.with(labelValues)
+	for i, bound := range m.buckets {
+		if v <= bound {
+			s.bucketCounts[i]++
+		}
+	}
+	s.count++
+	s.value += v
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string, extra ...string) string {
+	var pairs []string
+	for i, name := range names {
+		pairs = append(pairs, name+`="`+labelEscaper.Replace(values[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+extra[i+1]+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func (m *metric) writeTo(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := m.series[key]
+		if m.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, formatLabels(m.labels, s.labelValues), formatFloat(s.value))
+			continue
+		}
+		for i, bound := range m.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(m.labels, s.labelValues, "le", formatFloat(bound)), s.bucketCounts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(m.labels, s.labelValues, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, formatLabels(m.labels, s.labelValues), formatFloat(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, formatLabels(m.labels, s.labelValues), s.count)
+	}
+}
+
+func (r *registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, m := range r.metrics {
+		m.writeTo(w)
+	}
+}
+
+// IDs and phone numbers in paths would give us a series per guest.
+var (
+	idInPath         = regexp.MustCompile(`/[0-9]+(/|$)`)
+	phoneInPathLabel = regexp.MustCompile(`/phone/[^/]+`)
+)
+
+func endpointLabel(path string) string {
+	path = phoneInPathLabel.ReplaceAllString(path, "/phone/:phone")
+	// Twice, since adjacent IDs share a slash
+	path = idInPath.ReplaceAllString(path, "/:id$1")
+	return idInPath.ReplaceAllString(path, "/:id$1")
+}
+
+// metricsTransport counts requests to one API and times them.
+type metricsTransport struct {
+	client string
+	next   http.RoundTripper
+}
+
+func (t *metricsTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	endpoint := endpointLabel(r.URL.Path)
+	start := time.Now()
+	resp, err := t.next.RoundTrip(r)
+	apiLatency.observe(time.Since(start).Seconds(), t.client, endpoint)
+	if err != nil {
+		apiRequests.inc(t.client, endpoint, "error")
+	} else {
+		apiRequests.inc(t.client, endpoint, strconv.Itoa(resp.StatusCode))
+	}
+	return resp, err
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matthewbloch/text-guests/textmagic"
+	"github.com/matthewbloch/text-guests/uplisting"
+)
+
+// value is what a series stands at, or for a histogram how many it's seen.
+func (m *metric) value(labelValues ...string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.series[strings.Join(labelValues, "\x00")]
+	switch {
+	case !ok:
+		return 0
+	case m.kind == "histogram":
+		return float64(s.count)
+	}
+	return s.value
+}
+
+func TestRegistryServeHTTP(t *testing.T) {
+	r := &registry{}
+	sent := r.counter("test_sent_total", "Messages sent, by template.", "template")
+	last := r.gauge("test_last_run_timestamp_seconds", "When we last ran.")
+	latency := r.histogram("test_duration_seconds", "How long it took.", []float64{0.1, 1}, "client")
+
+	sent.inc("RECENT")
+	sent.inc("RECENT")
+	sent.inc(`OLD "quoted"`)
+	last.set(1700000000)
+	latency.observe(0.05, "uplisting")
+	latency.observe(0.5, "uplisting")
+
+	server := httptest.NewServer(r)
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := resp.Header.Get("Content-Type"); !strings.HasPrefix(got, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type %q", got)
+	}
+	want := `# HELP test_sent_total Messages sent, by template.
+# TYPE test_sent_total counter
+test_sent_total{template="OLD \"quoted\""} 1
+test_sent_total{template="RECENT"} 2
+# HELP test_last_run_timestamp_seconds When we last ran.
+# TYPE test_last_run_timestamp_seconds gauge
+test_last_run_timestamp_seconds 1.7e+09
+# HELP test_duration_seconds How long it took.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{client="uplisting",le="0.1"} 1
+test_duration_seconds_bucket{client="uplisting",le="1"} 2
+test_duration_seconds_bucket{client="uplisting",le="+Inf"} 2
+test_duration_seconds_sum{client="uplisting"} 0.55
+test_duration_seconds_count{client="uplisting"} 2
+`
+	if string(body) != want {
+		t.Errorf("got\n%s\nwant\n%s", body, want)
+	}
+}
+
+func TestEndpointLabel(t *testing.T) {
+	tests := map[string]string{
+		"/api/v2/ping":                         "/api/v2/ping",
+		"/api/v2/contacts/4271917":             "/api/v2/contacts/:id",
+		"/api/v2/contacts/phone/447700900123":  "/api/v2/contacts/phone/:phone",
+		"/api/v2/contacts/phone/+447700900123": "/api/v2/contacts/phone/:phone",
+		"/api/v2/lists/7/contacts":             "/api/v2/lists/:id/contacts",
+		"/api/v2/customfields/12/update":       "/api/v2/customfields/:id/update",
+		"/api/v2/sessions/900/messages":        "/api/v2/sessions/:id/messages",
+		"/bookings/2693371/show":               "/bookings/:id/show",
+		"/calendar/7458":                       "/calendar/:id",
+		"/things/1/2/3":                        "/things/:id/:id/:id",
+	}
+	for path, want := range tests {
+		if got := endpointLabel(path); got != want {
+			t.Errorf("endpointLabel(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestMetricsTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/phone/") {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+	client := &http.Client{Transport: &metricsTransport{"test", http.DefaultTransport}}
+
+	contacts := apiRequests.value("test", "/api/v2/contacts/:id", "200")
+	phones := apiRequests.value("test", "/api/v2/contacts/phone/:phone", "404")
+	timed := apiLatency.value("test", "/api/v2/contacts/:id")
+	for _, path := range []string{
+		"/api/v2/contacts/4271917",
+		"/api/v2/contacts/4271918",
+		"/api/v2/contacts/phone/447700900123",
+	} {
+		resp, err := client.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	if got := apiRequests.value("test", "/api/v2/contacts/:id", "200") - contacts; got != 2 {
+		t.Errorf("counted %v requests for contacts by ID, want 2", got)
+	}
+	if got := apiRequests.value("test", "/api/v2/contacts/phone/:phone", "404") - phones; got != 1 {
+		t.Errorf("counted %v requests for contacts by phone, want 1", got)
+	}
+	if got := apiLatency.value("test", "/api/v2/contacts/:id") - timed; got != 2 {
+		t.Errorf("timed %v requests for contacts by ID, want 2", got)
+	}
+	if got := apiRequests.value("test", "/api/v2/contacts/4271917", "200"); got != 0 {
+		t.Errorf("contact ID got its own series")
+	}
+
+	// Requests which never get an answer are counted as errors
+	server.Close()
+	if resp, err := client.Get(server.URL + "/api/v2/ping"); err == nil {
+		resp.Body.Close()
+		t.Fatal("request to closed server succeeded")
+	}
+	if got := apiRequests.value("test", "/api/v2/ping", "error"); got != 1 {
+		t.Errorf("counted %v failed requests, want 1", got)
+	}
+}
+
+// A guest who opted out long ago is skipped every run, but that's not
+// another opt-out.
+func TestBlockedGuestSkipped(t *testing.T) {
+	s := state{report: newRunReport()}
+	g := newGuest(&identity{bookings: []uplisting.Booking{stay(1, "2023-11-04", 5, 500, uplisting.ChannelAirbnb)}})
+	g.contact = textmagic.Contact{Id: 42, Blocked: true}
+
+	optedOut := optOuts.value()
+	skipped := skipsTotal.value("opted out")
+	if _, ok := s.prepareSend(config{}, g, time.Now()); ok {
+		t.Fatal("blocked guest would be texted")
+	}
+	if got := optOuts.value() - optedOut; got != 0 {
+		t.Errorf("counted %v opt-outs, want none", got)
+	}
+	if got := skipsTotal.value("opted out") - skipped; got != 1 {
+		t.Errorf("counted %v skips, want 1", got)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/exp/slog"
+
+	"github.com/matthewbloch/text-guests/textmagic"
+	"github.com/matthewbloch/text-guests/uplisting"
+)
+
+/* Guests reply to our texts, mostly to ask about availability. TextMagic
+ * calls the daemon back at /webhooks/textmagic (or /webhooks/textmagic/<tenant>)
+ * with each reply, and with the delivery status of each text we sent, once
+ * TEXTMAGIC_WEBHOOK_SECRET is set. A reply that's just STOP or the like
+ * blocks the guest's contact; anything else is passed on to us by email or
+ * webhook, with what we know of the guest's stays, so it doesn't sit unseen
+ * in TextMagic.
+ */
+
+// How long we give REPLY_FORWARD_URL to take a reply.
+const replyForwardTimeout = 10 * time.Second
+
+// isOptOut says whether a reply is one of the keywords, give or take case
+// and punctuation, and nothing else.
+func isOptOut(text string, keywords []string) bool {
+	text = strings.TrimFunc(text, func(r rune) bool { return unicode.IsSpace(r) || unicode.IsPunct(r) })
+	for _, keyword := range keywords {
+		if strings.EqualFold(text, strings.TrimSpace(keyword)) {
+			return true
+		}
+	}
+	return false
+}
+
+// guestByPhone puts together what we know of the guest with this number from
+// the bookings we've kept, or returns nil if we've never seen it.
+func guestByPhone(bookings []uplisting.Booking, phone string, minConfidence float64) *guest {
+	identities, _ := resolveIdentities(activeBookings(bookings), minConfidence)
+	for _, id := range identities {
+		for _, booking := range id.bookings {
+			if booking.GuestPhone == phone {
+				return newGuest(id)
+			}
+		}
+	}
+	return nil
+}
+
+// forwardedReply is a guest's reply, as we pass it on.
+type forwardedReply struct {
+	Tenant     string             `json:"tenant,omitempty"`
+	Phone      string             `json:"phone"`
+	Name       string             `json:"name"`
+	Email      string             `json:"email,omitempty"`
+	Text       string             `json:"text"`
+	ReceivedAt time.Time          `json:"received_at"`
+	Stays      int                `json:"stays"`
+	LastStay   *uplisting.Booking `json:"last_stay,omitempty"`
+}
+
+func newForwardedReply(config config, reply textmagic.Reply, phone string, receivedAt time.Time, g *guest) forwardedReply {
+	f := forwardedReply{
+		Tenant:     config.Tenant,
+		Phone:      phone,
+		Name:       strings.TrimSpace(reply.FirstName + " " + reply.LastName),
+		Text:       reply.Text,
+		ReceivedAt: receivedAt,
+	}
+	if g != nil {
+		lastStay := g.lastStay()
+		f.Stays = len(g.stays)
+		f.LastStay = &lastStay
+		f.Email = g.email()
+		if f.Name == "" {
+			f.Name = lastStay.GuestName
+		}
+	}
+	return f
+}
+
+// subject is the email subject for a reply.
+func (f forwardedReply) subject() string {
+	if f.Name == "" {
+		return "Text from " + f.Phone
+	}
+	return "Text from " + f.Name + " (" + f.Phone + ")"
+}
+
+// body is the reply, and what we know about who sent it, as plain text.
+func (f forwardedReply) body() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n\n", f.Text)
+	fmt.Fprintf(&b, "From:      %s %s\n", f.Name, f.Phone)
+	if f.Email != "" {
+		fmt.Fprintf(&b, "Email:     %s\n", f.Email)
+	}
+	fmt.Fprintf(&b, "Received:  %s\n", f.ReceivedAt.Format("Mon 2 Jan 2006 15:04"))
+	if f.Tenant != "" {
+		fmt.Fprintf(&b, "Tenant:    %s\n", f.Tenant)
+	}
+	if f.LastStay == nil {
+		fmt.Fprintf(&b, "\nWe don't have any bookings for this number.\n")
+		return b.String()
+	}
+	stay := f.LastStay
+	fmt.Fprintf(&b, "Stays:     %d\n\n", f.Stays)
+	fmt.Fprintf(&b, "Last stay: %s, %s to %s (%d nights)\n", stay.PropertyName, stay.CheckIn, stay.CheckOut, stay.NumberOfNights)
+	fmt.Fprintf(&b, "           %d guests, via %s, %s %.2f\n", stay.NumberOfGuests, stay.Channel, stay.Currency, stay.TotalPayout)
+	fmt.Fprintf(&b, "           Uplisting booking %d, %s\n", stay.ID, stay.Status)
+	return b.String()
+}
+
+// emailReply passes a reply on by email through the local mail server.
+func emailReply(config config, f forwardedReply) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", config.ReplyForwardFrom)
+	fmt.Fprintf(&msg, "To: %s\r\n", config.ReplyForwardEmail)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", f.subject()))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(f.body(), "\n", "\r\n"))
+	return smtp.SendMail(config.SMTPAddr, nil, config.ReplyForwardFrom, []string{config.ReplyForwardEmail}, msg.Bytes())
+}
+
+// postReply passes a reply on to REPLY_FORWARD_URL as JSON.
+func postReply(config config, f forwardedReply) error {
+	body, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	client := http.Client{Timeout: replyForwardTimeout}
+	resp, err := client.Post(config.ReplyForwardURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s returned %s", config.ReplyForwardURL, resp.Status)
+	}
+	return nil
+}
+
+// forwardReply passes a reply on to wherever we've been told to.
+func forwardReply(config config, f forwardedReply) {
+	if config.ReplyForwardEmail != "" {
+		if err := emailReply(config, f); err != nil {
+			slog.Error("Couldn't email reply from "+f.Phone+":", "cause", err)
+			errorsTotal.inc("forward reply")
+		}
+	}
+	if config.ReplyForwardURL != "" {
+		if err := postReply(config, f); err != nil {
+			slog.Error("Couldn't forward reply from "+f.Phone+":", "cause", err)
+			errorsTotal.inc("forward reply")
+		}
+	}
+}
+
+// handleReply records a guest's reply, then opts them out or passes it on.
+func handleReply(config config, client *textmagic.Client, reply textmagic.Reply) error {
+	phone := normalizePhone(reply.Sender)
+	receivedAt := reply.MessageTime.Time
+	if receivedAt.IsZero() {
+		receivedAt = time.Now()
+	}
+	optOut := isOptOut(reply.Text, config.OptOutKeywords)
+	event := "reply"
+	if optOut {
+		event = "opt_out"
+	}
+	webhooksTotal.inc("textmagic", event)
+	slog.Info("Reply", "tenant", config.Tenant, "phone", phone, "optOut", optOut)
+
+	store, err := openStore(config.StateFile)
+	if err != nil {
+		return fmt.Errorf("couldn't read %s: %w", config.StateFile, err)
+	}
+	isNew := store.recordReply(replyRecord{
+		Phone:      phone,
+		ContactId:  reply.ContactId,
+		MessageId:  reply.Id,
+		Text:       reply.Text,
+		ReceivedAt: receivedAt,
+		OptOut:     optOut,
+	})
+	if err := store.save(); err != nil {
+		return fmt.Errorf("couldn't save %s: %w", config.StateFile, err)
+	}
+
+	if optOut {
+		if err := client.BlockContact(phone); err != nil {
+			errorsTotal.inc("opt out")
+			return fmt.Errorf("couldn't block %s: %w", phone, err)
+		}
+		optOuts.inc()
+		slog.Info("Opted out " + phone)
+		return nil
+	}
+	if !isNew {
+		// TextMagic's trying again, and we've already passed it on
+		return nil
+	}
+	g := guestByPhone(store.bookings(), phone, config.IdentityMinConfidence)
+	forwardReply(config, newForwardedReply(config, reply, phone, receivedAt, g))
+	return nil
+}
+
+// handleStatus notes a delivery status against the text we sent.
+func handleStatus(config config, status textmagic.MessageStatus) error {
+	webhooksTotal.inc("textmagic", "status")
+	phone := normalizePhone(status.Receiver)
+	at := status.MessageTime.Time
+	if at.IsZero() {
+		at = time.Now()
+	}
+	if messageFailed(status.Status) {
+		slog.Warn("Text to "+phone+" failed", "tenant", config.Tenant, "status", status.Status, "id", status.Id)
+	}
+
+	store, err := openStore(config.StateFile)
+	if err != nil {
+		return fmt.Errorf("couldn't read %s: %w", config.StateFile, err)
+	}
+	if !store.recordStatus(status.Id, phone, status.Status, at) {
+		slog.Debug("Status for a text we didn't send", "phone", phone, "id", status.Id)
+		return nil
+	}
+	return store.save()
+}
+
+// textmagicWebhook takes TextMagic's reply and delivery status callbacks for
+// one tenant.
+type textmagicWebhook struct {
+	config    config
+	textmagic *textmagic.Client
+}
+
+func (h textmagicWebhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	token := r.URL.Query().Get("token")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(h.config.TextMagicWebhookSecret)) != 1 {
+		slog.Warn("TextMagic callback with a bad token", "tenant", h.config.Tenant, "remote", r.RemoteAddr)
+		webhooksTotal.inc("textmagic", "unverified")
+		http.Error(w, "bad token", http.StatusUnauthorized)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxWebhookSize)
+	reply, status, err := textmagic.ParseCallback(r)
+	if err != nil {
+		slog.Warn("Couldn't decode TextMagic callback:", "cause", err)
+		webhooksTotal.inc("textmagic", "invalid")
+		http.Error(w, "couldn't decode callback: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if status != nil {
+		err = handleStatus(h.config, *status)
+	} else {
+		err = handleReply(h.config, h.textmagic, *reply)
+	}
+	if err != nil {
+		slog.Error("Couldn't handle TextMagic callback:", "cause", err)
+		http.Error(w, "couldn't handle callback", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/matthewbloch/text-guests/textmagic"
+)
+
+func TestIsOptOut(t *testing.T) {
+	keywords := defaultConfig().OptOutKeywords
+	for text, want := range map[string]bool{
+		"STOP":                   true,
+		"stop":                   true,
+		" Stop. ":                true,
+		"unsubscribe!":           true,
+		"Don't stop":             false,
+		"Stop texting me please": false,
+		"Are you free in May?":   false,
+		"":                       false,
+	} {
+		if got := isOptOut(text, keywords); got != want {
+			t.Errorf("isOptOut(%q) = %v, want %v", text, got, want)
+		}
+	}
+}
+
+func TestHandleReplyOptOut(t *testing.T) {
+	var blocked []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/api/v2/contacts/block" {
+			t.Errorf("unexpected %s %s", r.Method, r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		var body map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("couldn't decode block: %v", err)
+		}
+		blocked = append(blocked, body["phone"])
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id":42,"href":"/api/v2/contacts/42"}`))
+	}))
+	defer server.Close()
+	client := &textmagic.Client{Http: server.Client(), Base: server.URL}
+
+	c := defaultConfig()
+	c.StateFile = filepath.Join(t.TempDir(), "state.json")
+	optedOut := optOuts.value()
+
+	if err := handleReply(c, client, textmagic.Reply{Id: 1, Sender: "447700900123", Text: "Are you free in May?"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(blocked) != 0 || optOuts.value() != optedOut {
+		t.Errorf("blocked %v after a question", blocked)
+	}
+
+	if err := handleReply(c, client, textmagic.Reply{Id: 2, Sender: "447700900123", Text: "STOP"}); err != nil {
+		t.Fatal(err)
+	}
+	if want := normalizePhone("447700900123"); len(blocked) != 1 || blocked[0] != want {
+		t.Errorf("blocked %v, want just %s", blocked, want)
+	}
+	if got := optOuts.value() - optedOut; got != 1 {
+		t.Errorf("counted %v opt-outs, want 1", got)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// runReport counts what happened during one run, so nightly runs can be
+// compared. It's safe to use from several goroutines, and a nil report
+// counts nothing.
+type runReport struct {
+	mu sync.Mutex
+
+	Tenant            string         `json:"tenant,omitempty"`
+	StartedAt         time.Time      `json:"startedAt"`
+	DurationSeconds   float64        `json:"durationSeconds"`
+	PropertiesScanned int            `json:"propertiesScanned"`
+	BookingsSeen      int            `json:"bookingsSeen"`
+	CancelledSkipped  int            `json:"cancelledSkipped"`
+	Guests            int            `json:"guests"`
+	ContactsCreated   int            `json:"contactsCreated"`
+	ContactsSynced    int            `json:"contactsSynced"`
+	SentByTemplate    map[string]int `json:"sentByTemplate"`
+	SkipsByReason     map[string]int `json:"skipsByReason"`
+	ErrorsByCategory  map[string]int `json:"errorsByCategory"`
+	// Set if the run stopped early
+	Failure string `json:"failure,omitempty"`
+}
+
+func newRunReport() *runReport {
+	return &runReport{
+		StartedAt:        time.Now(),
+		SentByTemplate:   make(map[string]int),
+		SkipsByReason:    make(map[string]int),
+		ErrorsByCategory: make(map[string]int),
+	}
+}
+
+func (r *runReport) add(fn func(r *runReport)) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fn(r)
+}
+
+func (r *runReport) skip(reason string) {
+	skipsTotal.inc(reason)
+	r.add(func(r *runReport) { r.SkipsByReason[reason]++ })
+}
+
+func (r *runReport) error(category string) {
+	errorsTotal.inc(category)
+	r.add(func(r *runReport) { r.ErrorsByCategory[category]++ })
+}
+
+func (r *runReport) sent(template string) {
+	messagesSent.inc(template)
+	r.add(func(r *runReport) { r.SentByTemplate[template]++ })
+}
+
+func (r *runReport) finish(err error) {
+	r.add(func(r *runReport) {
+		r.DurationSeconds = time.Since(r.StartedAt).Seconds()
+		if err != nil {
+			r.Failure = err.Error()
+		}
+	})
+}
+
+func (r *runReport) writeJSON(w io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+func writeCounts(tw io.Writer, heading string, counts map[string]int) {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(tw, "%s: %s\t%d\n", heading, key, counts[key])
+	}
+}
+
+func (r *runReport) writeTable(w io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	if r.Tenant != "" {
+		fmt.Fprintf(tw, "Tenant\t%s\n", r.Tenant)
+	}
+	fmt.Fprintf(tw, "Started\t%s\n", r.StartedAt.Format(time.RFC3339))
+	fmt.Fprintf(tw, "Duration\t%.1fs\n", r.DurationSeconds)
+	fmt.Fprintf(tw, "Properties scanned\t%d\n", r.PropertiesScanned)
+	fmt.Fprintf(tw, "Bookings seen\t%d\n", r.BookingsSeen)
+	fmt.Fprintf(tw, "Cancelled skipped\t%d\n", r.CancelledSkipped)
+	fmt.Fprintf(tw, "Guests\t%d\n", r.Guests)
+	fmt.Fprintf(tw, "Contacts created\t%d\n", r.ContactsCreated)
+	fmt.Fprintf(tw, "Contacts synced\t%d\n", r.ContactsSynced)
+	writeCounts(tw, "Sent", r.SentByTemplate)
+	writeCounts(tw, "Skipped", r.SkipsByReason)
+	writeCounts(tw, "Errors", r.ErrorsByCategory)
+	if r.Failure != "" {
+		fmt.Fprintf(tw, "Failed\t%s\n", r.Failure)
+	}
+	return tw.Flush()
+}
+
+// write puts the JSON report wherever REPORT_FILE says, "-" being stdout,
+// and the table on stdout, or stderr if that's where the JSON went.
+func (r *runReport) write(reportFile string) error {
+	table := io.Writer(os.Stdout)
+	switch reportFile {
+	case "":
+	case "-":
+		table = os.Stderr
+		if err := r.writeJSON(os.Stdout); err != nil {
+			return err
+		}
+	default:
+		f, err := os.Create(reportFile)
+		if err != nil {
+			return err
+		}
+		if err := r.writeJSON(f); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	return r.writeTable(table)
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+
+	"github.com/matthewbloch/text-guests/textmagic"
+	"github.com/matthewbloch/text-guests/uplisting"
+)
+
+// runAndReport does one campaign run and reports on it, returning an error
+// if it failed.
+func runAndReport(config config, uplistingClient *uplisting.Client, textmagicClient *textmagic.Client) error {
+	report := newRunReport()
+	report.Tenant = config.Tenant
+	err := runCampaign(config, uplistingClient, textmagicClient, report)
+	report.finish(err)
+
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	runsTotal.inc(config.Tenant, result)
+	lastRun.set(float64(time.Now().Unix()), config.Tenant, result)
+
+	if err := report.write(config.ReportFile); err != nil {
+		slog.Error("Couldn't write report:", "error", err)
+	}
+	return err
+}
+
+// Only one run or webhook at a time decides who to text, so nobody gets
+// texted twice.
+var campaignLock sync.Mutex
+
+// prepareCampaign gets everything we need before we can text anyone: our
+// state store, TextMagic's custom fields and list, the templates, and
+// Uplisting's properties.
+func prepareCampaign(config config, uplistingClient *uplisting.Client, textmagicClient *textmagic.Client, report *runReport) (state, []uplisting.Property, error) {
+	var state state = NewState(report)
+
+	store, err := openStore(config.StateFile)
+	if err != nil {
+		report.error("state store")
+		return state, nil, fmt.Errorf("couldn't read %s: %w", config.StateFile, err)
+	}
+	state.store = store
+
+	if _, err := textmagicClient.Ping(); err != nil {
+		report.error("textmagic setup")
+		return state, nil, fmt.Errorf("TextMagic did not return ping: %w", err)
+	}
+
+	if fields, err := textmagicClient.GetCustomFields(); err != nil {
+		report.error("textmagic setup")
+		return state, nil, fmt.Errorf("TextMagic did not return custom fields: %w", err)
+	} else {
+		for _, wanted := range []struct {
+			name  string
+			field *textmagic.CustomField
+		}{
+			{config.TextMagicContactStateName, &state.stateField},
+			{config.TextMagicLastPropertyName, &state.lastPropertyField},
+			{config.TextMagicLastStayName, &state.lastStayField},
+			{config.TextMagicStayCountName, &state.stayCountField},
+			{config.TextMagicLocaleName, &state.localeField},
+		} {
+			if wanted.name == "" {
+				continue
+			}
+			field, ok := findCustomField(fields, wanted.name)
+			if !ok {
+				report.error("textmagic setup")
+				return state, nil, fmt.Errorf("TextMagic did not have a custom field %q, run text-guests bootstrap", wanted.name)
+			}
+			*wanted.field = field
+		}
+	}
+
+	if lists, err := textmagicClient.GetLists(); err != nil {
+		report.error("textmagic setup")
+		return state, nil, fmt.Errorf("TextMagic did not return lists: %w", err)
+	} else {
+		for _, list := range lists {
+			if list.Name == config.TextMagicListName {
+				state.listId = int(list.Id)
+				goto foundList
+			}
+		}
+		report.error("textmagic setup")
+		return state, nil, fmt.Errorf("TextMagic did not have a list %q, run text-guests bootstrap", config.TextMagicListName)
+	}
+foundList:
+
+	if state.variants, err = parseTemplateVariants(config.TemplateVariants); err != nil {
+		report.error("templates")
+		return state, nil, err
+	}
+	state.locales = config.locales()
+	if state.localeCountries, err = config.localeCountries(); err != nil {
+		report.error("templates")
+		return state, nil, err
+	}
+	groups, groupNames, err := config.propertyGroups()
+	if err != nil {
+		report.error("templates")
+		return state, nil, err
+	}
+	if state.templateSets, err = loadTemplateSets(config, textmagicClient, state.variants, groupNames); err != nil {
+		report.error("templates")
+		return state, nil, fmt.Errorf("couldn't load templates: %w", err)
+	}
+
+	properties, err := uplistingClient.GetProperties()
+	if err != nil {
+		report.error("uplisting properties")
+		return state, nil, fmt.Errorf("Uplisting did not return list of properties: %w", err)
+	}
+	report.add(func(r *runReport) { r.PropertiesScanned = len(properties) })
+	state.propertyGroups = propertyGroups(groups, properties)
+	return state, properties, nil
+}
+
+// saveStore writes the state store, logging and counting any problem.
+func (s state) saveStore(path string) {
+	if err := s.store.save(); err != nil {
+		slog.Error("Couldn't save "+path+":", "cause", err)
+		s.report.error("state store")
+	}
+}
+
+// runCampaign is one normal run: find every recent guest, bring their
+// TextMagic contact up to date, and text the ones who are due a message.
+// Problems with individual guests are logged and counted in the report; an
+// error means the run couldn't carry on.
+func runCampaign(config config, uplistingClient *uplisting.Client, textmagicClient *textmagic.Client, report *runReport) error {
+	campaignLock.Lock()
+	defer campaignLock.Unlock()
+	now := time.Now()
+
+	state, properties, err := prepareCampaign(config, uplistingClient, textmagicClient, report)
+	if err != nil {
+		return err
+	}
+	defer state.saveStore(config.StateFile)
+
+	var bookings []uplisting.Booking
+
+	fetched := fetchBookings(uplistingClient, properties, now.Add(bookingLookback), now, config.UplistingWorkers, report)
+	state.store.recordBookings(fetched)
+	for _, booking := range fetched {
+		report.add(func(r *runReport) { r.BookingsSeen++ })
+		if booking.Status == uplisting.StatusCancelled {
+			report.add(func(r *runReport) { r.CancelledSkipped++ })
+			continue
+		}
+		slog.Info("Booking", "property", booking.PropertyName, "phone", booking.GuestPhone, "arrival", booking.ArrivalAt(), "departure", booking.DepartureAt(), "name", booking.GuestName)
+		bookings = append(bookings, booking)
+	}
+
+	identities, _ := resolveIdentities(bookings, config.IdentityMinConfidence)
+	guests := make([]*guest, len(identities))
+	parallel(len(identities), config.TextMagicWorkers, func(i int) {
+		guests[i] = state.findGuestContact(textmagicClient, identities[i])
+	})
+	for _, g := range guests {
+		if g == nil {
+			continue
+		}
+		if config.TextMagicPropertyListPrefix != "" {
+			for _, stay := range g.stays {
+				state.segments.add(config.TextMagicPropertyListPrefix+stay.PropertyName, g.contact.Id)
+			}
+		}
+		state.guests = append(state.guests, g)
+	}
+	report.add(func(r *runReport) { r.Guests = len(state.guests) })
+
+	for _, g := range state.guests {
+		slog.Info("Guest", "phone", g.contact.Phone, "firstName", g.contact.FirstName, "lastName", g.contact.LastName, "stays", len(g.stays), "firstStay", g.firstStay().DepartureAt(), "lastStay", g.lastStay().DepartureAt(), "nights", g.totalNights, "revenue", g.totalRevenue, "channels", g.channels)
+	}
+
+	/* Now decide on the appropriate text for each guest */
+	var sends []pendingSend
+	for _, g := range state.guests {
+		if send, ok := state.prepareSend(config, g, now); ok {
+			sends = append(sends, send)
+		}
+	}
+
+	// hardwired test mode
+	if false {
+		for _, send := range sends {
+			contact := send.guest.contact
+			slog.Info("Would send message to "+contact.Phone, "template", send.template, "variant", send.variant, "sendAt", send.sendAt)
+			slog.Info("Would update contact "+contact.Phone+":", "state", formatContactState(send.template, send.variant, now), "previous template", send.lastTemplate, "previous sendAt", send.lastSent)
+		}
+		return nil
+	}
+
+	var outcomes []sendOutcome
+	if config.BatchSend {
+		outcomes = sendBatched(textmagicClient, sends, config.BatchSize)
+	} else {
+		outcomes = sendIndividually(textmagicClient, sends)
+	}
+
+	if err := state.completeSends(config, textmagicClient, outcomes, now); err != nil {
+		return err
+	}
+
+	if err := state.segments.flush(textmagicClient); err != nil {
+		slog.Error("Couldn't update guest lists:", "cause", err)
+		report.error("lists")
+	}
+	return nil
+}
+
+// prepareSend decides what, if anything, to text a guest now, and renders
+// it. Guests who shouldn't be texted are counted in the report.
+func (state state) prepareSend(config config, g *guest, now time.Time) (pendingSend, bool) {
+	report := state.report
+	contact := g.contact
+
+	if contact.Blocked {
+		report.skip("opted out")
+		return pendingSend{}, false
+	}
+
+	stateRaw, _ := contact.CustomFieldValue(state.stateField.Id)
+	lastTemplate, lastSent := parseContactState(stateRaw)
+
+	template, reason := chooseTemplate(g, lastTemplate, lastSent, now)
+	if template == "" {
+		report.skip(reason)
+		return pendingSend{}, false
+	}
+
+	variant := chooseVariant(state.variants, template, g.phone())
+	code, err := state.store.discountCode(g, template, config.DiscountCodePrefix, config.DiscountCodeLength)
+	if err != nil {
+		slog.Error("Couldn't issue discount code for "+contact.Phone+":", "cause", err)
+		report.error("discount code")
+		return pendingSend{}, false
+	}
+	set := state.templateSet(g)
+	locale := state.guestLocale(g)
+	text, err := renderTemplate(set.templates[localizedName(variant, locale, state.locales[0])], g, code)
+	if err != nil {
+		slog.Error("Couldn't render "+variant+" for "+contact.Phone+":", "cause", err)
+		report.error("render")
+		return pendingSend{}, false
+	}
+
+	// People book in the evenings, send reminders at 7pm
+	sendAt := time.Date(now.Year(), now.Month(), now.Day(), 19, 0, 0, 0, time.Local)
+	if sendAt.Before(now) {
+		sendAt = sendAt.Add(time.Hour * 24)
+	}
+
+	return pendingSend{
+		guest:        g,
+		template:     template,
+		variant:      variant,
+		locale:       locale,
+		code:         code,
+		from:         set.from,
+		text:         text,
+		sendAt:       sendAt,
+		lastTemplate: lastTemplate,
+		lastSent:     lastSent,
+	}, true
+}
+
+// completeSends records what we sent to whom, in TextMagic and our own
+// store, and counts the failures.
+func (state state) completeSends(config config, textmagicClient *textmagic.Client, outcomes []sendOutcome, now time.Time) error {
+	report := state.report
+	for _, outcome := range outcomes {
+		contact := outcome.guest.contact
+		if outcome.err != nil {
+			slog.Error("Couldn't send message to "+contact.Phone+":", "cause", outcome.err)
+			report.error("send")
+			continue
+		}
+		slog.Info("Sent message to "+contact.Phone, "id", outcome.id(), "session", outcome.result.SessionId, "bulk", outcome.result.BulkId, "status", outcome.status)
+		report.sent(outcome.template)
+		state.store.codeSent(outcome.code, outcome.sendAt)
+		state.store.recordSend(sendRecord{
+			Phone:     outcome.guest.phone(),
+			Email:     outcome.guest.email(),
+			ContactId: contact.Id,
+			Template:  outcome.template,
+			Variant:   outcome.variant,
+			Locale:    outcome.locale,
+			Property:  outcome.guest.lastStay().PropertyName,
+			SentAt:    outcome.sendAt,
+			MessageId: outcome.id(),
+			// A scheduled batch is "scheduled" until TextMagic's status
+			// callback tells us what became of this guest's text
+			Status: outcome.status,
+		})
+		if config.TextMagicCampaignListPrefix != "" {
+			state.segments.add(config.TextMagicCampaignListPrefix+outcome.template, contact.Id)
+		}
+
+		// Update our state field if the message is scheduled successfully.
+		if err := textmagicClient.SetCustomFieldValue(state.stateField.Id, contact.Id, formatContactState(outcome.template, outcome.variant, now)); err != nil {
+			// If we can't remember what we sent, we'd send it again next time
+			report.error("state update")
+			return fmt.Errorf("couldn't update contact %s: %w", contact.Phone, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"golang.org/x/exp/slog"
+
+	"github.com/matthewbloch/text-guests/textmagic"
+)
+
+// TextMagic doesn't say how many contacts it'll take at once, so we stay
+// modest.
+const listAssignBatch = 100
+
+// segments collects the contacts we want on each of our per-property and
+// per-campaign lists, so they can be assigned in bulk at the end of a run.
+type segments struct {
+	members map[string][]int
+}
+
+func newSegments() *segments {
+	return &segments{members: make(map[string][]int)}
+}
+
+func (s *segments) add(listName string, contactId int) {
+	for _, id := range s.members[listName] {
+		if id == contactId {
+			return
+		}
+	}
+	s.members[listName] = append(s.members[listName], contactId)
+}
+
+// flush creates any lists which don't exist yet and assigns their members.
+func (s *segments) flush(client *textmagic.Client) error {
+	if len(s.members) == 0 {
+		return nil
+	}
+	lists, err := client.GetLists()
+	if err != nil {
+		return err
+	}
+	byName := make(map[string]int)
+	for _, list := range lists {
+		byName[list.Name] = list.Id
+	}
+
+	names := make([]string, 0, len(s.members))
+	for name := range s.members {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		listId, ok := byName[name]
+		if !ok {
+			list, err := client.CreateList(name)
+			if err != nil {
+				return fmt.Errorf("creating list %q: %w", name, err)
+			}
+			listId = list.Id
+			slog.Info("Created list", "name", name, "id", listId)
+		}
+		members := s.members[name]
+		for start := 0; start < len(members); start += listAssignBatch {
+			end := start + listAssignBatch
+			if end > len(members) {
+				end = len(members)
+			}
+			if err := client.AssignContactsToList(listId, members[start:end]); err != nil {
+				return fmt.Errorf("assigning contacts to list %q: %w", name, err)
+			}
+		}
+		slog.Info("Assigned contacts to list", "name", name, "contacts", len(members))
+	}
+	return nil
+}
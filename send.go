@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"golang.org/x/exp/slog"
+
+	"github.com/matthewbloch/text-guests/textmagic"
+)
+
+// messageFailed says whether TextMagic's status for a message means it won't
+// be delivered: "f" failed, "e" error or "j" rejected. Anything else,
+// including no status yet, might still get there.
+func messageFailed(status string) bool {
+	switch status {
+	case "f", "e", "j":
+		return true
+	}
+	return false
+}
+
+// pendingSend is a message we've decided to send to a guest.
+type pendingSend struct {
+	guest        *guest
+	template     string
+	variant      string
+	locale       string
+	code         string
+	from         string
+	text         string
+	sendAt       time.Time
+	lastTemplate string
+	lastSent     time.Time
+}
+
+// sendOutcome is what became of one guest's message.
+type sendOutcome struct {
+	pendingSend
+	result textmagic.SendResult
+	// TextMagic's status for the message, where we know it.
+	status string
+	err    error
+}
+
+func (o sendOutcome) id() int {
+	switch {
+	case o.result.MessageId != 0:
+		return o.result.MessageId
+	case o.result.ScheduleId != 0:
+		return o.result.ScheduleId
+	case o.result.BulkId != 0:
+		return o.result.BulkId
+	}
+	return o.result.SessionId
+}
+
+func toMessage(send pendingSend, contacts []textmagic.Contact) textmagic.MessageToContacts {
+	return textmagic.MessageToContacts{
+		Text:     send.text,
+		Contacts: contacts,
+		SendAt:   send.sendAt,
+		From:     send.from,
+	}
+}
+
+// sendIndividually sends each guest their own message.
+func sendIndividually(client *textmagic.Client, sends []pendingSend) (outcomes []sendOutcome) {
+	for _, send := range sends {
+		result, err := client.SendToContacts(toMessage(send, []textmagic.Contact{send.guest.contact}))
+		outcomes = append(outcomes, sendOutcome{pendingSend: send, result: result, err: err})
+	}
+	return outcomes
+}
+
+// sendBatched sends one message to every guest who's due exactly the same
+// text at the same time, up to batchSize at once, then works out what
+// happened to each of them.
+func sendBatched(client *textmagic.Client, sends []pendingSend, batchSize int) (outcomes []sendOutcome) {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	var keys []string
+	groups := make(map[string][]pendingSend)
+	for _, send := range sends {
+		key := strconv.FormatInt(send.sendAt.Unix(), 10) + "\x00" + send.from + "\x00" + send.text
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], send)
+	}
+	if len(sends) > 1 && len(keys) == len(sends) {
+		// Most likely the templates have {{.FirstName}} or {{.DiscountCode}}
+		// in them, so each text is the guest's own
+		slog.Warn("No two guests are due the same text, so none were batched", "sends", len(sends))
+	}
+
+	for _, key := range keys {
+		group := groups[key]
+		for start := 0; start < len(group); start += batchSize {
+			end := start + batchSize
+			if end > len(group) {
+				end = len(group)
+			}
+			outcomes = append(outcomes, sendBatch(client, group[start:end])...)
+		}
+	}
+	return outcomes
+}
+
+func sendBatch(client *textmagic.Client, batch []pendingSend) []sendOutcome {
+	var contacts []textmagic.Contact
+	for _, send := range batch {
+		contacts = append(contacts, send.guest.contact)
+	}
+	result, err := client.SendToContacts(toMessage(batch[0], contacts))
+
+	outcomes := make([]sendOutcome, len(batch))
+	for i, send := range batch {
+		outcomes[i] = sendOutcome{pendingSend: send, result: result, err: err}
+	}
+	if err != nil {
+		return outcomes
+	}
+	slog.Info("Sent batch", "template", batch[0].template, "contacts", len(batch), "session", result.SessionId, "bulk", result.BulkId, "schedule", result.ScheduleId)
+
+	switch {
+	case result.ScheduleId != 0:
+		// Nothing's been sent yet. TextMagic's status callbacks will tell us
+		// what became of each guest's text once it goes, and they're matched
+		// to our record of it by phone.
+		setStatus(outcomes, "scheduled")
+	case result.BulkId != 0:
+		// Too big for TextMagic to send straight away, so we can only say how
+		// far it's got.
+		bulk, err := client.GetBulkSession(result.BulkId)
+		if err != nil {
+			slog.Warn("Couldn't check bulk session", "bulk", result.BulkId, "cause", err)
+			setStatus(outcomes, "bulk")
+		} else {
+			setStatus(outcomes, fmt.Sprintf("bulk %s %d/%d", bulk.Status, bulk.ItemsProcessed, bulk.ItemsTotal))
+		}
+	case result.SessionId != 0:
+		messages := make(map[int]textmagic.SentMessage)
+		err := client.EachSessionMessage(result.SessionId, func(m textmagic.SentMessage) error {
+			messages[m.ContactId] = m
+			return nil
+		})
+		if err != nil {
+			slog.Warn("Couldn't check session messages", "session", result.SessionId, "cause", err)
+			setStatus(outcomes, "sent")
+			break
+		}
+		for i := range outcomes {
+			// TextMagic accepted the message, so one it hasn't listed or given
+			// a status yet is on its way, as far as we know.
+			m, ok := messages[outcomes[i].guest.contact.Id]
+			if !ok || m.Status == "" {
+				outcomes[i].status = "pending"
+				continue
+			}
+			if messageFailed(m.Status) {
+				outcomes[i].err = fmt.Errorf("message status %q in session %d", m.Status, result.SessionId)
+			}
+			outcomes[i].result.MessageId = m.Id
+			outcomes[i].status = m.Status
+		}
+	default:
+		setStatus(outcomes, "sent")
+	}
+	return outcomes
+}
+
+func setStatus(outcomes []sendOutcome, status string) {
+	for i := range outcomes {
+		outcomes[i].status = status
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matthewbloch/text-guests/textmagic"
+	"github.com/matthewbloch/text-guests/uplisting"
+)
+
+func TestMessageFailed(t *testing.T) {
+	for status, want := range map[string]bool{
+		"f": true, "e": true, "j": true,
+		"d": false, "q": false, "s": false, "a": false, "u": false,
+		"": false, "fej": false, "ef": false,
+	} {
+		if got := messageFailed(status); got != want {
+			t.Errorf("messageFailed(%q) = %v, want %v", status, got, want)
+		}
+	}
+}
+
+func TestSendBatchSession(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/api/v2/messages":
+			var message textmagic.Message
+			if err := json.NewDecoder(r.Body).Decode(&message); err != nil {
+				t.Errorf("couldn't decode message: %v", err)
+			}
+			if message.Contacts != "1,2,3,4" {
+				t.Errorf("sent to %q, want 1,2,3,4", message.Contacts)
+			}
+			if message.SendingDateTime != "" {
+				t.Errorf("batch scheduled for %s", message.SendingDateTime)
+			}
+			w.Write([]byte(`{"id":900,"href":"/api/v2/sessions/900","type":"session","sessionId":900}`))
+		case r.Method == "GET" && r.URL.Path == "/api/v2/sessions/900/messages":
+			w.Write([]byte(`{"page":1,"pageCount":1,"limit":100,"resources":[
+				{"id":5001,"contactId":1,"sessionId":900,"receiver":"447700900001","status":"d"},
+				{"id":5002,"contactId":2,"sessionId":900,"receiver":"447700900002","status":"f"},
+				{"id":5003,"contactId":3,"sessionId":900,"receiver":"447700900003","status":""}
+			]}`))
+		default:
+			t.Errorf("unexpected %s %s", r.Method, r.URL.Path)
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	client := &textmagic.Client{Http: server.Client(), Base: server.URL}
+
+	now := time.Now()
+	var batch []pendingSend
+	for id := 1; id <= 4; id++ {
+		g := newGuest(&identity{bookings: []uplisting.Booking{stay(id, "2023-11-04", 5, 500, uplisting.ChannelAirbnb)}})
+		g.contact = textmagic.Contact{Id: id}
+		batch = append(batch, pendingSend{guest: g, template: "RECENT", text: "Thanks!", sendAt: now})
+	}
+
+	outcomes := sendBatch(client, batch)
+	want := []struct {
+		status string
+		failed bool
+		id     int
+	}{
+		{"d", false, 5001},
+		{"f", true, 5002},
+		{"pending", false, 900},
+		{"pending", false, 900},
+	}
+	for i, outcome := range outcomes {
+		if outcome.status != want[i].status || (outcome.err != nil) != want[i].failed || outcome.id() != want[i].id {
+			t.Errorf("contact %d: status %q, err %v, id %d, want %q, failed %v, id %d",
+				i+1, outcome.status, outcome.err, outcome.id(), want[i].status, want[i].failed, want[i].id)
+		}
+	}
+}
+
+// A batch for 7pm is scheduled, and each guest's status arrives later by
+// callback, for the message TextMagic sent them rather than the schedule.
+func TestSendBatchScheduled(t *testing.T) {
+	sendAt := time.Now().Add(6 * time.Hour).Truncate(time.Second)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var message textmagic.Message
+		if err := json.NewDecoder(r.Body).Decode(&message); err != nil {
+			t.Errorf("couldn't decode message: %v", err)
+		}
+		if want := sendAt.Format("2006-01-02 15:04:05"); message.SendingDateTime != want {
+			t.Errorf("batch scheduled for %q, want %q", message.SendingDateTime, want)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":9001,"href":"/api/v2/schedules/9001","type":"schedule","scheduleId":9001}`))
+	}))
+	defer server.Close()
+	client := &textmagic.Client{Http: server.Client(), Base: server.URL}
+
+	var batch []pendingSend
+	for id := 1; id <= 2; id++ {
+		b := stay(id, "2023-11-04", 5, 500, uplisting.ChannelAirbnb)
+		b.GuestPhone = fmt.Sprintf("44770090000%d", id)
+		g := newGuest(&identity{bookings: []uplisting.Booking{b}})
+		g.contact = textmagic.Contact{Id: id}
+		batch = append(batch, pendingSend{guest: g, template: "RECENT", text: "Thanks!", sendAt: sendAt})
+	}
+
+	store, err := openStore(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, outcome := range sendBatch(client, batch) {
+		if outcome.err != nil || outcome.status != "scheduled" || outcome.id() != 9001 {
+			t.Fatalf("outcome %q, %v, id %d", outcome.status, outcome.err, outcome.id())
+		}
+		store.recordSend(sendRecord{Phone: outcome.guest.phone(), SentAt: outcome.sendAt, MessageId: outcome.id(), Status: outcome.status})
+	}
+
+	delivered := sendAt.Add(time.Minute)
+	store.recordStatus(5001, "447700900001", "d", delivered)
+	store.recordStatus(5002, "447700900002", "f", delivered)
+	for i, want := range []string{"d", "f"} {
+		if got := store.sends()[i].Status; got != want {
+			t.Errorf("guest %d: status %q, want %q", i+1, got, want)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/matthewbloch/text-guests/uplisting"
+)
+
+/* TextMagic's contacts only have room for the last thing we sent each guest,
+ * so we keep our own history in a JSON file alongside. It's small, and only
+ * one run should be writing it at a time.
+ */
+
+// sendRecord is one text we sent, and enough about the guest to find them in
+// Uplisting's bookings later.
+type sendRecord struct {
+	Phone     string    `json:"phone"`
+	Email     string    `json:"email,omitempty"`
+	ContactId int       `json:"contact_id"`
+	Template  string    `json:"template"`
+	Variant   string    `json:"variant,omitempty"`
+	Locale    string    `json:"locale,omitempty"`
+	Property  string    `json:"property"`
+	SentAt    time.Time `json:"sent_at"`
+	MessageId int       `json:"message_id,omitempty"`
+	// TextMagic's delivery status, if it's told us
+	Status   string     `json:"status,omitempty"`
+	StatusAt *time.Time `json:"status_at,omitempty"`
+}
+
+// replyRecord is a text a guest sent us.
+type replyRecord struct {
+	Phone      string    `json:"phone"`
+	ContactId  int       `json:"contact_id,omitempty"`
+	MessageId  int       `json:"message_id"`
+	Text       string    `json:"text"`
+	ReceivedAt time.Time `json:"received_at"`
+	OptOut     bool      `json:"opt_out,omitempty"`
+}
+
+type storeData struct {
+	Sends   []sendRecord   `json:"sends"`
+	Codes   []discountCode `json:"codes"`
+	Replies []replyRecord  `json:"replies"`
+	// The latest we've heard of every booking, from runs and webhooks, by ID
+	Bookings map[string]uplisting.Booking `json:"bookings"`
+}
+
+type store struct {
+	path string
+
+	mu   sync.Mutex
+	data storeData
+}
+
+// Stores we've already opened, so runs and webhooks in the same process
+// share one rather than overwriting each other's changes.
+var (
+	openStoresMu sync.Mutex
+	openStores   = make(map[string]*store)
+)
+
+// openStore reads the store at path, or starts an empty one if there isn't
+// a file there yet. An empty path gives a store which is never saved.
+func openStore(path string) (*store, error) {
+	s := &store{path: path}
+	if path == "" {
+		return s, nil
+	}
+	openStoresMu.Lock()
+	defer openStoresMu.Unlock()
+	if open, ok := openStores[path]; ok {
+		return open, nil
+	}
+	f, err := os.Open(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		defer f.Close()
+		if err := json.NewDecoder(f).Decode(&s.data); err != nil {
+			return nil, err
+		}
+	}
+	openStores[path] = s
+	return s, nil
+}
+
+// save writes the store to a temporary file and renames it into place, so a
+// crash never leaves us with half a history.
+func (s *store) save() error {
+	if s.path == "" {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	encoder := json.NewEncoder(tmp)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(s.data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+func (s *store) recordSend(record sendRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Sends = append(s.data.Sends, record)
+}
+
+// sends returns a copy of the send history, oldest first.
+func (s *store) sends() []sendRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]sendRecord(nil), s.data.Sends...)
+}
+
+// recordStatus notes TextMagic's delivery status on the message we sent.
+// Scheduled messages were recorded before they had a message ID of their
+// own, so failing that it goes on our last text to the receiver before the
+// status. It returns false if we can't find the message.
+func (s *store) recordStatus(messageId int, phone, status string, at time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	found := -1
+	for i, send := range s.data.Sends {
+		if send.MessageId == messageId {
+			found = i
+			break
+		}
+		if send.Phone == phone && !send.SentAt.After(at) {
+			found = i
+		}
+	}
+	if found < 0 {
+		return false
+	}
+	s.data.Sends[found].Status = status
+	s.data.Sends[found].StatusAt = &at
+	return true
+}
+
+// recordReply keeps a reply, returning false if we already had it.
+func (s *store) recordReply(record replyRecord) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, reply := range s.data.Replies {
+		if reply.MessageId == record.MessageId {
+			return false
+		}
+	}
+	s.data.Replies = append(s.data.Replies, record)
+	return true
+}
+
+// replies returns a copy of every reply we've had, oldest first.
+func (s *store) replies() []replyRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]replyRecord(nil), s.data.Replies...)
+}
+
+// recordBookings remembers the latest version of each booking.
+func (s *store) recordBookings(bookings []uplisting.Booking) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data.Bookings == nil {
+		s.data.Bookings = make(map[string]uplisting.Booking)
+	}
+	for _, booking := range bookings {
+		s.data.Bookings[strconv.Itoa(booking.ID)] = booking
+	}
+}
+
+// bookings returns every booking we know of, in no particular order.
+func (s *store) bookings() []uplisting.Booking {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bookings := make([]uplisting.Booking, 0, len(s.data.Bookings))
+	for _, booking := range s.data.Bookings {
+		bookings = append(bookings, booking)
+	}
+	return bookings
+}
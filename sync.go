@@ -0,0 +1,166 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"golang.org/x/exp/slog"
+
+	"github.com/matthewbloch/text-guests/textmagic"
+)
+
+// email is the most recent real address the guest has given us, or failing
+// that the most recent OTA relay address.
+func (g *guest) email() string {
+	var relay string
+	for i := len(g.stays) - 1; i >= 0; i-- {
+		if email := realEmail(g.stays[i].GuestEmail); email != "" {
+			return email
+		}
+		if relay == "" {
+			relay = g.stays[i].GuestEmail
+		}
+	}
+	return relay
+}
+
+func inList(contact textmagic.Contact, listId int) bool {
+	for _, list := range contact.Lists {
+		if list.Id == listId {
+			return true
+		}
+	}
+	return false
+}
+
+type fieldValue struct {
+	field textmagic.CustomField
+	value string
+}
+
+// syncFields are the custom fields we keep up to date from Uplisting, and the
+// value each should have for a guest.
+func (s state) syncFields(g *guest) (fields []fieldValue) {
+	lastStay := g.lastStay()
+	if s.lastPropertyField.Id != 0 {
+		fields = append(fields, fieldValue{s.lastPropertyField, lastStay.PropertyName})
+	}
+	if s.lastStayField.Id != 0 {
+		fields = append(fields, fieldValue{s.lastStayField, lastStay.CheckOut})
+	}
+	if s.stayCountField.Id != 0 {
+		fields = append(fields, fieldValue{s.stayCountField, strconv.Itoa(len(g.stays))})
+	}
+	return fields
+}
+
+// newContact is the contact we create for a guest we've not texted before,
+// already as syncContact would leave it.
+func (s state) newContact(g *guest) (c textmagic.Contact) {
+	c.Phone = g.phone()
+	c.FirstName, c.LastName = contactName(g.lastStay())
+	c.Email = g.email()
+	c.Lists = []textmagic.List{{Id: s.listId}}
+	for _, f := range s.syncFields(g) {
+		c = c.SetCustomFieldValue(f.field, f.value)
+	}
+	return c
+}
+
+// syncContact brings a guest's TextMagic contact up to date with what
+// Uplisting tells us about them, fills in any name it's missing, and makes
+// sure they're on our list. If anything has changed, custom fields included,
+// it's all written back in one update. It returns the contact as it now
+// stands.
+func (s state) syncContact(client *textmagic.Client, g *guest) (textmagic.Contact, error) {
+	contact := g.contact
+	lastStay := g.lastStay()
+
+	updated := contact
+	// Names are only filled in, never replaced, so we don't undo anything
+	// that's been put right in TextMagic
+	first, last := contactName(lastStay)
+	if strings.TrimSpace(updated.FirstName) == "" {
+		updated.FirstName = first
+	}
+	if strings.TrimSpace(updated.LastName) == "" {
+		updated.LastName = last
+	}
+	// Don't swap a real address we already have for an OTA relay one
+	if email := g.email(); email != "" && (realEmail(email) != "" || contact.Email == "") {
+		updated.Email = email
+	}
+	if !inList(updated, s.listId) {
+		updated.Lists = append(updated.Lists, textmagic.List{Id: s.listId})
+	}
+
+	var changed []string
+	if updated.FirstName != contact.FirstName {
+		changed = append(changed, "firstName")
+	}
+	if updated.LastName != contact.LastName {
+		changed = append(changed, "lastName")
+	}
+	if updated.Email != contact.Email {
+		changed = append(changed, "email")
+	}
+	if len(updated.Lists) != len(contact.Lists) {
+		changed = append(changed, "lists")
+	}
+	for _, f := range s.syncFields(g) {
+		if current, ok := updated.CustomFieldValue(f.field.Id); ok && current == f.value {
+			continue
+		}
+		updated = updated.SetCustomFieldValue(f.field, f.value)
+		changed = append(changed, f.field.Name)
+	}
+
+	if len(changed) == 0 {
+		return contact, nil
+	}
+	if err := client.UpdateContact(updated); err != nil {
+		return contact, err
+	}
+	slog.Info("Synced contact "+updated.Phone, "changed", changed)
+	s.report.add(func(r *runReport) { r.ContactsSynced++ })
+	return updated, nil
+}
+
+// findGuestContact builds the guest record for an identity, finding or
+// creating their TextMagic contact and bringing it up to date. It returns nil
+// if we can't get a contact for them.
+func (s state) findGuestContact(client *textmagic.Client, id *identity) *guest {
+	g := newGuest(id)
+	phone := g.phone()
+	if phone == "" {
+		slog.Warn("No phone number for guest", "name", g.lastStay().GuestName)
+		s.report.skip("no phone number")
+		return nil
+	}
+
+	/* Find or create a contact */
+	contact, err := client.GetContactByPhone(phone)
+	if err != nil {
+		if err == textmagic.ErrNotFound {
+			if contact, err = client.CreateContact(s.newContact(g)); err != nil {
+				slog.Warn("Couldn't create contact for "+phone+":", "cause", err)
+				s.report.error("create contact")
+				return nil
+			} else {
+				slog.Info("Created contact for " + phone)
+				s.report.add(func(r *runReport) { r.ContactsCreated++ })
+			}
+		} else {
+			slog.Error("Problem fetching contact for "+phone+":", "cause", err)
+			s.report.error("fetch contact")
+			return nil
+		}
+	}
+	g.contact = contact
+
+	if g.contact, err = s.syncContact(client, g); err != nil {
+		slog.Warn("Couldn't sync contact for "+phone+":", "cause", err)
+		s.report.error("sync contact")
+	}
+	return g
+}
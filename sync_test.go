@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matthewbloch/text-guests/textmagic"
+	"github.com/matthewbloch/text-guests/uplisting"
+)
+
+// fakeTextMagic has no contacts to find by phone, and answers everything
+// else with an empty success, keeping the body of each PUT or POST it's sent
+// by path.
+func fakeTextMagic(t *testing.T) (*textmagic.Client, map[string][]map[string]interface{}) {
+	bodies := make(map[string][]map[string]interface{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/api/v2/contacts/phone/") {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"code":404,"message":"Contact not found"}`))
+			return
+		}
+		if r.Method == "PUT" || r.Method == "POST" {
+			var body map[string]interface{}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				t.Errorf("couldn't decode %s: %v", r.URL.Path, err)
+			}
+			bodies[r.URL.Path] = append(bodies[r.URL.Path], body)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":42,"href":"/api/v2/contacts/42"}`))
+	}))
+	t.Cleanup(server.Close)
+	return &textmagic.Client{Http: server.Client(), Base: server.URL}, bodies
+}
+
+func TestSyncContactNames(t *testing.T) {
+	tests := []struct {
+		name                string
+		contact             textmagic.Contact
+		stay                uplisting.Booking
+		preferred           string
+		firstName, lastName string
+	}{
+		{
+			name:      "corrected in TextMagic",
+			contact:   textmagic.Contact{FirstName: "Dot", LastName: "Rodríguez Smith"},
+			stay:      stay(1, "2023-11-04", 5, 500, uplisting.ChannelAirbnb),
+			firstName: "Dot",
+			lastName:  "Rodríguez Smith",
+		},
+		{
+			name:      "no name yet",
+			stay:      stay(1, "2023-11-04", 5, 500, uplisting.ChannelAirbnb),
+			firstName: "Doris",
+			lastName:  "Rodríguez",
+		},
+		{
+			name:      "preferred name",
+			stay:      stay(1, "2023-11-04", 5, 500, uplisting.ChannelAirbnb),
+			preferred: "Dot Rodríguez",
+			firstName: "Dot",
+			lastName:  "Rodríguez",
+		},
+		{
+			name: "Booking.com, surname first",
+			stay: stay(1, "2023-11-04", 5, 500, uplisting.ChannelBookingDotCom),
+		},
+		{
+			name:      "Booking.com, preferred name",
+			stay:      stay(1, "2023-11-04", 5, 500, uplisting.ChannelBookingDotCom),
+			preferred: "Doris Rodríguez",
+			firstName: "Doris",
+			lastName:  "Rodríguez",
+		},
+		{
+			name:      "Booking.com, already named",
+			contact:   textmagic.Contact{FirstName: "Doris", LastName: "Rodríguez"},
+			stay:      stay(1, "2023-11-04", 5, 500, uplisting.ChannelBookingDotCom),
+			firstName: "Doris",
+			lastName:  "Rodríguez",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, bodies := fakeTextMagic(t)
+			s := state{listId: 7, report: newRunReport()}
+			b := test.stay
+			if b.Channel == uplisting.ChannelBookingDotCom {
+				b.GuestName = "Rodríguez Doris"
+			}
+			b.PreferredGuestName = test.preferred
+			g := newGuest(&identity{bookings: []uplisting.Booking{b}})
+			g.contact = test.contact
+			g.contact.Id = 42
+			g.contact.Phone = b.GuestPhone
+
+			contact, err := s.syncContact(client, g)
+			if err != nil {
+				t.Fatal(err)
+			}
+			updates := bodies["/api/v2/contacts/42"]
+			if contact.FirstName != test.firstName || contact.LastName != test.lastName {
+				t.Errorf("name = %q %q, want %q %q", contact.FirstName, contact.LastName, test.firstName, test.lastName)
+			}
+			if len(updates) != 1 {
+				t.Fatalf("%d updates, want 1", len(updates))
+			}
+			if got := updates[0]["firstName"]; test.firstName != "" && got != test.firstName {
+				t.Errorf("sent firstName %v, want %q", got, test.firstName)
+			}
+		})
+	}
+}
+
+// An opted-out guest must stay blocked when we update their contact.
+func TestSyncContactKeepsBlocked(t *testing.T) {
+	client, bodies := fakeTextMagic(t)
+	s := state{listId: 7, report: newRunReport()}
+	g := newGuest(&identity{bookings: []uplisting.Booking{stay(1, "2023-11-04", 5, 500, uplisting.ChannelAirbnb)}})
+	g.contact = textmagic.Contact{Id: 42, Phone: "+447700900123", FirstName: "Doris", Blocked: true}
+
+	if _, err := s.syncContact(client, g); err != nil {
+		t.Fatal(err)
+	}
+	updates := bodies["/api/v2/contacts/42"]
+	if len(updates) != 1 {
+		t.Fatalf("%d updates, want 1", len(updates))
+	}
+	if blocked := updates[0]["blocked"]; blocked != true {
+		t.Errorf("sent blocked %v, want true", blocked)
+	}
+}
+
+// Changed custom fields go in the contact update, not a request each.
+func TestSyncContactFields(t *testing.T) {
+	client, bodies := fakeTextMagic(t)
+	s := state{
+		listId:            7,
+		report:            newRunReport(),
+		lastPropertyField: textmagic.CustomField{Id: 11, Name: "Last property"},
+		lastStayField:     textmagic.CustomField{Id: 12, Name: "Last stay"},
+		stayCountField:    textmagic.CustomField{Id: 13, Name: "Stays"},
+	}
+	b := stay(1, "2023-11-04", 5, 500, uplisting.ChannelAirbnb)
+	b.PropertyName = "Agar Street"
+	g := newGuest(&identity{bookings: []uplisting.Booking{b}})
+	g.contact = textmagic.Contact{
+		Id:                42,
+		Phone:             b.GuestPhone,
+		FirstName:         "Doris",
+		LastName:          "Rodríguez",
+		Lists:             []textmagic.List{{Id: 7}},
+		CustomFieldValues: []textmagic.CustomFieldValue{{Id: 11, Value: "Agar Street"}, {Id: 12, Value: "2022-06-10"}},
+	}
+
+	contact, err := s.syncContact(client, g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updates := bodies["/api/v2/contacts/42"]
+	if len(updates) != 1 {
+		t.Fatalf("%d updates, want 1", len(updates))
+	}
+	sent := make(map[float64]interface{})
+	values, _ := updates[0]["customFieldValues"].([]interface{})
+	for _, v := range values {
+		v, _ := v.(map[string]interface{})
+		id, _ := v["id"].(float64)
+		sent[id] = v["value"]
+	}
+	for id, want := range map[float64]string{11: "Agar Street", 12: "2023-11-04", 13: "1"} {
+		if sent[id] != want {
+			t.Errorf("sent field %v = %v, want %q", id, sent[id], want)
+		}
+	}
+	for path := range bodies {
+		if strings.HasPrefix(path, "/api/v2/customfields/") {
+			t.Errorf("set a field on its own with %s", path)
+		}
+	}
+	for id, want := range map[int]string{11: "Agar Street", 12: "2023-11-04", 13: "1"} {
+		if got, _ := contact.CustomFieldValue(id); got != want {
+			t.Errorf("field %d = %q, want %q", id, got, want)
+		}
+	}
+
+	// Now it's up to date, there's nothing to send
+	g.contact = contact
+	if _, err := s.syncContact(client, g); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(bodies["/api/v2/contacts/42"]); n != 1 {
+		t.Errorf("%d updates after syncing twice, want 1", n)
+	}
+}
+
+// New contacts get the same names and fields as synced ones, in one
+// request, so a Booking.com guest isn't created as "Rodríguez Doris" and
+// then left that way.
+func TestFindGuestContactNames(t *testing.T) {
+	tests := []struct {
+		name                string
+		channel             uplisting.Channel
+		guestName           string
+		preferred           string
+		firstName, lastName string
+	}{
+		{"Airbnb", uplisting.ChannelAirbnb, "Doris Rodríguez", "", "Doris", "Rodríguez"},
+		{"Booking.com, surname first", uplisting.ChannelBookingDotCom, "Rodríguez Doris", "", "", ""},
+		{"Booking.com, preferred name", uplisting.ChannelBookingDotCom, "Rodríguez Doris", "Dot Rodríguez", "Dot", "Rodríguez"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, bodies := fakeTextMagic(t)
+			s := state{listId: 7, report: newRunReport(), stayCountField: textmagic.CustomField{Id: 13, Name: "Stays"}}
+			b := stay(1, "2023-11-04", 5, 500, test.channel)
+			b.GuestName, b.PreferredGuestName = test.guestName, test.preferred
+
+			g := s.findGuestContact(client, &identity{bookings: []uplisting.Booking{b}})
+			if g == nil {
+				t.Fatal("no guest")
+			}
+			creates := bodies["/api/v2/contacts/normalized"]
+			if len(creates) != 1 {
+				t.Fatalf("%d creates, want 1", len(creates))
+			}
+			for key, want := range map[string]string{"firstName": test.firstName, "lastName": test.lastName} {
+				if got, _ := creates[0][key].(string); got != want {
+					t.Errorf("created with %s %q, want %q", key, got, want)
+				}
+			}
+			// The new contact's complete, fields and all, so there's nothing
+			// more to send
+			values, _ := creates[0]["customFieldValues"].([]interface{})
+			if len(values) != 1 || values[0].(map[string]interface{})["value"] != "1" {
+				t.Errorf("created with customFieldValues %v, want the stay count", values)
+			}
+			if len(bodies) != 1 {
+				t.Errorf("sent %v after creating the contact", bodies)
+			}
+			if got := g.firstName(); got != test.firstName {
+				t.Errorf("firstName() = %q, want %q", got, test.firstName)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"golang.org/x/exp/slog"
+	"gopkg.in/yaml.v3"
+
+	"github.com/matthewbloch/text-guests/textmagic"
+	"github.com/matthewbloch/text-guests/uplisting"
+)
+
+/* One deployment can look after several owners, each with their own
+ * Uplisting and TextMagic accounts. The config file lists them under
+ * tenants:, each with a name and whichever settings differ from the rest of
+ * the file:
+ *
+ *   tenants:
+ *     - name: york
+ *       uplisting_api_key: ...
+ *       textmagic_username: ...
+ *
+ * Each tenant runs on its own, one after the other, with its own clients,
+ * state file and report, so one tenant's problems don't stop the others.
+ */
+
+// tenantConfig is one tenant's section of the config file, kept as YAML
+// until we know what it's overriding.
+type tenantConfig struct {
+	Name string
+	node yaml.Node
+}
+
+func (t *tenantConfig) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: a tenant should be a mapping of settings", node.Line)
+	}
+	t.node = *node
+	t.node.Content = nil
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == "name" {
+			t.Name = node.Content[i+1].Value
+			continue
+		}
+		t.node.Content = append(t.node.Content, node.Content[i], node.Content[i+1])
+	}
+	return nil
+}
+
+// configKeys are the settings a config file can have.
+func configKeys() map[string]bool {
+	keys := make(map[string]bool)
+	t := reflect.TypeOf(config{})
+	for i := 0; i < t.NumField(); i++ {
+		if key := t.Field(i).Tag.Get("yaml"); key != "" && key != "-" {
+			keys[key] = true
+		}
+	}
+	return keys
+}
+
+// tenantPath gives a tenant its own copy of a file, e.g. state-york.json, if
+// it hasn't been given one of its own.
+func tenantPath(path, base, tenant string) string {
+	if path == "" || path == "-" || path != base {
+		return path
+	}
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "-" + tenant + ext
+}
+
+// tenants is the config for each tenant: the rest of the config with the
+// tenant's own settings on top. Without any tenants, it's just the config.
+func (c config) tenants() ([]config, error) {
+	if len(c.Tenants) == 0 {
+		return []config{c}, nil
+	}
+	var problems configErrors
+	keys := configKeys()
+	seen := make(map[string]bool)
+	var tenants []config
+	for i, t := range c.Tenants {
+		path := fmt.Sprintf("tenants[%d]", i)
+		switch {
+		case t.Name == "":
+			problems.add(path+".name", "required")
+		case seen[t.Name]:
+			problems.add(path+".name", "%q is used by another tenant", t.Name)
+		}
+		seen[t.Name] = true
+
+		tenant := c
+		tenant.Tenants = nil
+		tenant.Tenant = t.Name
+		// Maps would be shared with the other tenants otherwise
+		tenant.Templates = make(map[string]string)
+		for name, text := range c.Templates {
+			tenant.Templates[name] = text
+		}
+		tenant.Senders = make(map[string]string)
+		for group, from := range c.Senders {
+			tenant.Senders[group] = from
+		}
+		tenant.Groups = append([]groupConfig(nil), c.Groups...)
+
+		unknown := false
+		for j := 0; j+1 < len(t.node.Content); j += 2 {
+			if key := t.node.Content[j].Value; !keys[key] || key == "tenants" {
+				problems.add(path+"."+key, "unknown setting")
+				unknown = true
+			}
+		}
+		if !unknown {
+			if err := t.node.Decode(&tenant); err != nil {
+				problems.add(path, "%v", err)
+			}
+		}
+		tenant.StateFile = tenantPath(tenant.StateFile, c.StateFile, t.Name)
+		tenant.ReportFile = tenantPath(tenant.ReportFile, c.ReportFile, t.Name)
+		tenants = append(tenants, tenant)
+	}
+	if len(problems) > 0 {
+		return nil, problems
+	}
+	return tenants, nil
+}
+
+// tenant picks the one tenant a command should work on, named by TENANT if
+// there's more than one.
+func (c config) tenant(name string) (config, error) {
+	tenants, err := c.tenants()
+	if err != nil {
+		return c, err
+	}
+	if len(c.Tenants) == 0 {
+		return tenants[0], nil
+	}
+	var names []string
+	for _, t := range tenants {
+		if t.Tenant == name {
+			return t, nil
+		}
+		names = append(names, t.Tenant)
+	}
+	if name == "" {
+		return c, fmt.Errorf("set TENANT to one of %s", strings.Join(names, ", "))
+	}
+	return c, fmt.Errorf("no tenant %q, expected one of %s", name, strings.Join(names, ", "))
+}
+
+// clients are the API clients for one tenant's accounts.
+func (c config) clients() (*uplisting.Client, *textmagic.Client) {
+	uplistingClient := uplisting.NewClient(c.UplistingApiKey)
+	uplistingClient.Base = c.UplistingApiBase
+	uplistingClient.Http = &http.Client{Transport: c.transport("uplisting", c.UplistingRateLimit)}
+	textmagicClient := textmagic.NewClient(c.TextMagicUsername, c.TextMagicApiKey)
+	textmagicClient.Base = c.TextMagicApiBase
+	textmagicClient.Http = &http.Client{Transport: c.transport("textmagic", c.TextMagicRateLimit)}
+	return uplistingClient, textmagicClient
+}
+
+// runTenants runs the campaign for each tenant in turn. A tenant that fails
+// is logged and reported, and we carry on with the next.
+func runTenants(tenants []config) error {
+	var failed []string
+	for _, tenant := range tenants {
+		if tenant.Tenant != "" {
+			slog.Info("Running tenant " + tenant.Tenant)
+		}
+		err := runTenant(tenant)
+		if err == nil {
+			continue
+		}
+		if len(tenants) == 1 {
+			return err
+		}
+		slog.Error("Run failed:", "tenant", tenant.Tenant, "error", err)
+		failed = append(failed, tenant.Tenant)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("runs failed for %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// runTenant runs one tenant, turning a panic into an error so it can't take
+// the other tenants down with it.
+func runTenant(tenant config) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	uplistingClient, textmagicClient := tenant.clients()
+	return runAndReport(tenant, uplistingClient, textmagicClient)
+}
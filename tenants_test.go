@@ -0,0 +1,188 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// loadTestConfig loads a config file and the environment the way main does,
+// from a file with the given YAML in it.
+func loadTestConfig(t *testing.T, yaml string) config {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "text-guests.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", path)
+	c, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestTenants(t *testing.T) {
+	t.Setenv("UPLISTING_API_KEY", "shared")
+	t.Setenv("TEMPLATE_RECENT", "Thanks from the environment")
+	t.Setenv("TEMPLATE_LEEDS_RECENT", "Thanks for staying in Leeds")
+	t.Setenv("TEXTMAGIC_FROM_LEEDS", "LeedsStays")
+	c := loadTestConfig(t, `
+textmagic_from: YorkHoliday
+state_file: state.json
+property_groups: ["Headingley House:LEEDS"]
+templates:
+  OLD: Come back
+tenants:
+  - name: york
+    textmagic_username: york
+  - name: harrogate
+    textmagic_username: harrogate
+    uplisting_api_key: harrogate
+    state_file: /var/lib/harrogate.json
+    templates:
+      RECENT: Thanks from Harrogate
+      LEEDS_RECENT: Thanks from Harrogate's Leeds flat
+    senders:
+      LEEDS: HarrogateStays
+`)
+	tenants, err := c.tenants()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tenants) != 2 {
+		t.Fatalf("got %d tenants", len(tenants))
+	}
+	york, harrogate := tenants[0], tenants[1]
+
+	tests := []struct {
+		name, got, want string
+	}{
+		{"york's name", york.Tenant, "york"},
+		{"york's username", york.TextMagicUsername, "york"},
+		{"york's key", york.UplistingApiKey, "shared"},
+		{"york's state file", york.StateFile, "state-york.json"},
+		{"york's OLD", york.configTemplate("OLD"), "Come back"},
+		{"york's RECENT", york.configTemplate("RECENT"), "Thanks from the environment"},
+		{"york's LEEDS RECENT", york.groupTemplate("LEEDS", "RECENT"), "Thanks for staying in Leeds"},
+		{"york's LEEDS sender", york.groupSender("LEEDS"), "LeedsStays"},
+		{"york's sender", york.groupSender("YORK"), "YorkHoliday"},
+
+		// A tenant's own settings beat the environment's
+		{"harrogate's key", harrogate.UplistingApiKey, "harrogate"},
+		{"harrogate's state file", harrogate.StateFile, "/var/lib/harrogate.json"},
+		{"harrogate's OLD", harrogate.configTemplate("OLD"), "Come back"},
+		{"harrogate's RECENT", harrogate.configTemplate("RECENT"), "Thanks from Harrogate"},
+		{"harrogate's LEEDS RECENT", harrogate.groupTemplate("LEEDS", "RECENT"), "Thanks from Harrogate's Leeds flat"},
+		{"harrogate's LEEDS sender", harrogate.groupSender("LEEDS"), "HarrogateStays"},
+	}
+	for _, test := range tests {
+		if test.got != test.want {
+			t.Errorf("%s = %q, want %q", test.name, test.got, test.want)
+		}
+	}
+	if c.configTemplate("RECENT") != "Thanks from the environment" || c.Senders["LEEDS"] != "LeedsStays" {
+		t.Errorf("harrogate's settings leaked into the rest of the config")
+	}
+}
+
+// The environment beats a group in the config file, but a tenant's own
+// groups beat the environment.
+func TestTenantGroups(t *testing.T) {
+	t.Setenv("TEMPLATE_LEEDS_RECENT", "Thanks for staying in Leeds")
+	t.Setenv("TEMPLATE_LEEDS_CITY_RECENT", "Thanks for staying in the city")
+	t.Setenv("TEXTMAGIC_FROM_LEEDS", "LeedsStays")
+	c := loadTestConfig(t, `
+groups:
+  - name: LEEDS
+    properties: [Headingley House]
+    from: Headingley
+    templates:
+      RECENT: Thanks from the file
+  - name: leeds_city
+    properties: [Leeds Loft]
+tenants:
+  - name: york
+  - name: harrogate
+    groups:
+      - name: LEEDS
+        properties: [Harrogate Road]
+        from: HarrogateStays
+        templates:
+          RECENT: Thanks from Harrogate
+`)
+	tenants, err := c.tenants()
+	if err != nil {
+		t.Fatal(err)
+	}
+	york, harrogate := tenants[0], tenants[1]
+	tests := []struct {
+		name, got, want string
+	}{
+		{"york's LEEDS RECENT", york.groupTemplate("LEEDS", "RECENT"), "Thanks for staying in Leeds"},
+		{"york's LEEDS_CITY RECENT", york.groupTemplate("LEEDS_CITY", "RECENT"), "Thanks for staying in the city"},
+		{"york's LEEDS sender", york.groupSender("LEEDS"), "LeedsStays"},
+		{"harrogate's LEEDS RECENT", harrogate.groupTemplate("LEEDS", "RECENT"), "Thanks from Harrogate"},
+		{"harrogate's LEEDS sender", harrogate.groupSender("LEEDS"), "HarrogateStays"},
+	}
+	for _, test := range tests {
+		if test.got != test.want {
+			t.Errorf("%s = %q, want %q", test.name, test.got, test.want)
+		}
+	}
+}
+
+func TestTenantsProblems(t *testing.T) {
+	c := loadTestConfig(t, `
+tenants:
+  - name: york
+  - name: york
+    textmagic_password: guess
+  - textmagic_username: nobody
+`)
+	_, err := c.tenants()
+	want := configErrors{
+		`tenants[1].name: "york" is used by another tenant`,
+		"tenants[1].textmagic_password: unknown setting",
+		"tenants[2].name: required",
+	}
+	if got, _ := err.(configErrors); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", err, want)
+	}
+}
+
+func TestTenant(t *testing.T) {
+	c := loadTestConfig(t, `
+tenants:
+  - name: york
+  - name: leeds
+`)
+	if tenant, err := c.tenant("leeds"); err != nil || tenant.Tenant != "leeds" {
+		t.Errorf("tenant(leeds) = %q, %v", tenant.Tenant, err)
+	}
+	if _, err := c.tenant(""); err == nil || !strings.Contains(err.Error(), "york, leeds") {
+		t.Errorf("tenant() = %v, want a list of tenants", err)
+	}
+	if _, err := c.tenant("hull"); err == nil {
+		t.Error("found a tenant that isn't there")
+	}
+}
+
+// A panic in one of a tenant's workers reaches runTenant, which can turn
+// it into that tenant's failure alone.
+func TestParallelPanic(t *testing.T) {
+	run := func() (recovered any) {
+		defer func() { recovered = recover() }()
+		parallel(20, 4, func(i int) {
+			if i == 3 {
+				panic("bad booking")
+			}
+		})
+		return nil
+	}
+	if got := run(); got != "bad booking" {
+		t.Errorf("recovered %v, want the worker's panic", got)
+	}
+}
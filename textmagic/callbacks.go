@@ -0,0 +1,95 @@
+package textmagic
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/* TextMagic can call us back when someone replies to a message, and as an
+ * outbound message's delivery status changes. Depending on the account's
+ * settings the callback is a form or JSON, with the same field names as the
+ * API's own messages.
+ */
+
+// MessageStatus is a delivery status callback for one outbound message.
+type MessageStatus struct {
+	Id          int
+	SessionId   int
+	Receiver    string
+	Status      string
+	MessageTime AlmostRFC3339Time
+}
+
+// callbackFields reads a callback's fields, whichever way it was sent.
+func callbackFields(r *http.Request) (map[string]string, error) {
+	fields := make(map[string]string)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/json" {
+		decoder := json.NewDecoder(r.Body)
+		decoder.UseNumber()
+		var values map[string]any
+		if err := decoder.Decode(&values); err != nil {
+			return nil, err
+		}
+		for name, value := range values {
+			if value != nil {
+				fields[name] = fmt.Sprint(value)
+			}
+		}
+		return fields, nil
+	}
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+	for name := range r.PostForm {
+		fields[name] = r.PostForm.Get(name)
+	}
+	return fields, nil
+}
+
+// callbackTime parses one of TextMagic's times, or gives the zero time.
+func callbackTime(s string) (t AlmostRFC3339Time) {
+	t.UnmarshalJSON([]byte(strconv.Quote(strings.TrimSpace(s))))
+	return t
+}
+
+// ParseCallback reads a callback into either the reply it tells us about, or
+// the status of a message we sent.
+func ParseCallback(r *http.Request) (reply *Reply, status *MessageStatus, err error) {
+	fields, err := callbackFields(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	id, err := strconv.Atoi(fields["id"])
+	if err != nil {
+		return nil, nil, fmt.Errorf("bad message id %q", fields["id"])
+	}
+	if s, ok := fields["status"]; ok {
+		sessionId, _ := strconv.Atoi(fields["sessionId"])
+		return nil, &MessageStatus{
+			Id:          id,
+			SessionId:   sessionId,
+			Receiver:    fields["receiver"],
+			Status:      s,
+			MessageTime: callbackTime(fields["messageTime"]),
+		}, nil
+	}
+	if fields["sender"] == "" {
+		return nil, nil, fmt.Errorf("neither a reply nor a status")
+	}
+	contactId, _ := strconv.Atoi(fields["contactId"])
+	return &Reply{
+		Id:          id,
+		ContactId:   contactId,
+		Sender:      fields["sender"],
+		Receiver:    fields["receiver"],
+		MessageTime: callbackTime(fields["messageTime"]),
+		Text:        fields["text"],
+		FirstName:   fields["firstName"],
+		LastName:    fields["lastName"],
+	}, nil, nil
+}
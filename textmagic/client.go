@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -170,20 +172,11 @@ type CustomField struct {
 }
 
 func (c Client) GetCustomFields() (customFields []CustomField, err error) {
-	resp, err := c.doRequest("GET", "/api/v2/customfields?page=1&limit=999", nil)
-	if err != nil {
-		return nil, err
-	}
-	var customFieldsResponse struct {
-		Page      int           `json:"page"`
-		PageCount int           `json:"pageCount"`
-		Limit     int           `json:"limit"`
-		Resources []CustomField `json:"resources"`
-	}
-	if err := json.NewDecoder(resp.Body).Decode(&customFieldsResponse); err != nil {
-		return nil, err
-	}
-	return customFieldsResponse.Resources, nil
+	return allResources[CustomField](c, "/api/v2/customfields", nil)
+}
+
+func (c Client) EachCustomField(fn func(CustomField) error) error {
+	return eachResource(c, "/api/v2/customfields", nil, fn)
 }
 
 type createdResponse struct {
@@ -227,24 +220,88 @@ type List struct {
 	Avatar       struct {
 		Href string `json:"href"`
 	} `json:"avatar"`
-	// FIXME: And the rest
+	User User `json:"user"`
 }
 
 func (c Client) GetLists() ([]List, error) {
-	resp, err := c.doRequest("GET", "/api/v2/lists?page=1&limit=999", nil)
+	return allResources[List](c, "/api/v2/lists", nil)
+}
+
+func (c Client) EachList(fn func(List) error) error {
+	return eachResource(c, "/api/v2/lists", nil, fn)
+}
+
+func (c Client) CreateList(name string) (List, error) {
+	body, err := json.Marshal(struct {
+		Name   string `json:"name"`
+		Shared bool   `json:"shared"`
+	}{name, false})
 	if err != nil {
-		return nil, err
+		return List{}, err
 	}
-	var listsResponse struct {
-		Page      int    `json:"page"`
-		PageCount int    `json:"pageCount"`
-		Limit     int    `json:"limit"`
-		Resources []List `json:"resources"`
+	resp, err := c.doRequest("POST", "/api/v2/lists", body)
+	if err != nil {
+		return List{}, err
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&listsResponse); err != nil {
-		return nil, err
+	var response createdResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return List{}, err
+	}
+	return List{Id: response.Id, Name: name}, nil
+}
+
+func (c Client) UpdateList(list List) error {
+	body, err := json.Marshal(struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+		Shared      bool   `json:"shared"`
+		Favorited   bool   `json:"favorited"`
+		IsDefault   bool   `json:"isDefault"`
+	}{list.Name, list.Description, list.Shared, list.Favorited, list.IsDefault})
+	if err != nil {
+		return err
+	}
+	resp, err := c.doRequest("PUT", fmt.Sprintf("/api/v2/lists/%d", list.Id), body)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (c Client) DeleteList(id int) error {
+	resp, err := c.doRequest("DELETE", fmt.Sprintf("/api/v2/lists/%d", id), nil)
+	if err != nil {
+		return err
 	}
-	return listsResponse.Resources, nil
+	return resp.Body.Close()
+}
+
+// AssignContactsToList adds contacts to a list, leaving any other lists
+// they're on alone.
+func (c Client) AssignContactsToList(listId int, contactIds []int) error {
+	resp, err := c.doRequestWithMap("PUT", fmt.Sprintf("/api/v2/lists/%d/contacts", listId), map[string]string{"contacts": joinIds(contactIds)})
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (c Client) UnassignContactsFromList(listId int, contactIds []int) error {
+	resp, err := c.doRequestWithMap("DELETE", fmt.Sprintf("/api/v2/lists/%d/contacts", listId), map[string]string{"contacts": joinIds(contactIds)})
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// joinIds formats IDs the way TextMagic likes them in a request, separated
+// by commas.
+func joinIds(ids []int) string {
+	s := make([]string, len(ids))
+	for i, id := range ids {
+		s[i] = strconv.Itoa(id)
+	}
+	return strings.Join(s, ",")
 }
 
 type Country struct {
@@ -257,9 +314,18 @@ type CustomFieldValue struct {
 	Id    int    `json:"id"`
 }
 
+// User is the TextMagic account (or sub-account) that owns something.
+type User struct {
+	Id        int    `json:"id"`
+	Username  string `json:"username"`
+	FirstName string `json:"firstName"`
+	LastName  string `json:"lastName"`
+}
+
 type Contact struct {
 	Id                int                `json:"id"`
 	Favorited         bool               `json:"favorited"`
+	Blocked           bool               `json:"blocked"`
 	FirstName         string             `json:"firstName"`
 	LastName          string             `json:"lastName"`
 	CompanyName       string             `json:"companyName"`
@@ -268,13 +334,22 @@ type Contact struct {
 	Country           Country            `json:"country"`
 	CustomFieldValues []CustomFieldValue `json:"customFields"`
 	Lists             []List             `json:"lists"`
-	// FIXME: and the rest https://sandbox.textmagic.com/#/Contacts/getContactByPhone
+	User              User               `json:"user"`
+	PhoneType         string             `json:"phoneType"`
+	Avatar            struct {
+		Href string `json:"href"`
+	} `json:"avatar"`
 }
 
 func (c Contact) SetCustomFieldValue(f CustomField, v string) Contact {
-	for _, value := range c.CustomFieldValues {
-		if value.Id == f.Id {
-			value.Value = v
+	// Copy so we don't change the values of the Contact we were called on
+	values := make([]CustomFieldValue, len(c.CustomFieldValues), len(c.CustomFieldValues)+1)
+	copy(values, c.CustomFieldValues)
+	c.CustomFieldValues = values
+
+	for i := range c.CustomFieldValues {
+		if c.CustomFieldValues[i].Id == f.Id {
+			c.CustomFieldValues[i].Value = v
 			return c
 		}
 	}
@@ -303,44 +378,141 @@ func (c Client) GetContactByPhone(phone string) (contact Contact, err error) {
 	return contactResponse, nil
 }
 
-func (c Client) CreateContact(contact Contact) (Contact, error) {
-	type createContactRequest struct {
-		FirstName         string             `json:"firstName,omitempty"`
-		LastName          string             `json:"lastName,omitempty"`
-		CompanyName       string             `json:"companyName,omitempty"`
-		Phone             string             `json:"phone"`
-		Email             string             `json:"email"`
-		Favorited         bool               `json:"favorited"`
-		Blocked           bool               `json:"blocked"`
-		Type              int                `json:"type"`
-		Lists             string             `json:"lists"`
-		CustomFieldValues []CustomFieldValue `json:"customFieldValues"`
-		//Local             int    `json:"local"` // FIXME: Add option to allow local number specificiation?
-		//Country           string `json:"country"`
-	}
-
-	request := createContactRequest{
+// contactRequest is the body TextMagic expects when creating or updating a
+// contact. Custom fields are sent as a list of {"id": <custom field id>,
+// "value": "..."} objects, and lists as a comma-separated string of IDs.
+type contactRequest struct {
+	FirstName         string             `json:"firstName,omitempty"`
+	LastName          string             `json:"lastName,omitempty"`
+	CompanyName       string             `json:"companyName,omitempty"`
+	Phone             string             `json:"phone"`
+	Email             string             `json:"email"`
+	Favorited         bool               `json:"favorited"`
+	Blocked           bool               `json:"blocked"`
+	Type              int                `json:"type"`
+	Lists             string             `json:"lists"`
+	CustomFieldValues []CustomFieldValue `json:"customFieldValues,omitempty"`
+	//Local             int    `json:"local"` // FIXME: Add option to allow local number specificiation?
+	//Country           string `json:"country"`
+}
+
+func newContactRequest(contact Contact) contactRequest {
+	request := contactRequest{
 		FirstName:   contact.FirstName,
 		LastName:    contact.LastName,
 		CompanyName: contact.CompanyName,
 		Phone:       contact.Phone,
 		Email:       contact.Email,
+		Favorited:   contact.Favorited,
+		Blocked:     contact.Blocked,
 		//Country:     contact.Country.Id,
-		Type: -1,
 	}
+	var listIds []int
 	for _, list := range contact.Lists {
-		if request.Lists != "" {
-			request.Lists = fmt.Sprintf("%s,%d", request.Lists, list.Id)
-		} else {
-			request.Lists = fmt.Sprintf("%d", list.Id)
+		listIds = append(listIds, list.Id)
+	}
+	request.Lists = joinIds(listIds)
+	request.CustomFieldValues = contact.CustomFieldValues
+	return request
+}
+
+func (c Client) GetContact(id int) (Contact, error) {
+	resp, err := c.doRequest("GET", fmt.Sprintf("/api/v2/contacts/%d", id), nil)
+	if err != nil {
+		return Contact{}, err
+	}
+	defer resp.Body.Close()
+	var contact Contact
+	if err := json.NewDecoder(resp.Body).Decode(&contact); err != nil {
+		return Contact{}, err
+	}
+	return contact, nil
+}
+
+func (c Client) GetContacts() ([]Contact, error) {
+	return allResources[Contact](c, "/api/v2/contacts", nil)
+}
+
+func (c Client) EachContact(fn func(Contact) error) error {
+	return eachResource(c, "/api/v2/contacts", nil, fn)
+}
+
+// ContactSearch narrows down SearchContacts; any fields left empty are
+// ignored.
+type ContactSearch struct {
+	// Matched against names, phone numbers and email addresses
+	Query          string
+	ListId         int
+	Ids            []int
+	IncludeBlocked bool
+}
+
+func (s ContactSearch) values() url.Values {
+	v := url.Values{}
+	if s.Query != "" {
+		v.Set("query", s.Query)
+	}
+	if s.ListId != 0 {
+		v.Set("listId", strconv.Itoa(s.ListId))
+	}
+	if len(s.Ids) > 0 {
+		v.Set("ids", joinIds(s.Ids))
+	}
+	if s.IncludeBlocked {
+		v.Set("includeBlocked", "1")
+	}
+	return v
+}
+
+func (c Client) SearchContacts(s ContactSearch) ([]Contact, error) {
+	return allResources[Contact](c, "/api/v2/contacts/search", s.values())
+}
+
+func (c Client) EachSearchContact(s ContactSearch, fn func(Contact) error) error {
+	return eachResource(c, "/api/v2/contacts/search", s.values(), fn)
+}
+
+// GetContactsByEmail returns the contacts whose email address is exactly
+// email, ignoring case. TextMagic can only search on it loosely.
+func (c Client) GetContactsByEmail(email string) (contacts []Contact, err error) {
+	err = c.EachSearchContact(ContactSearch{Query: email}, func(contact Contact) error {
+		if strings.EqualFold(contact.Email, email) {
+			contacts = append(contacts, contact)
 		}
+		return nil
+	})
+	return contacts, err
+}
+
+func (c Client) GetListContacts(listId int) ([]Contact, error) {
+	return allResources[Contact](c, fmt.Sprintf("/api/v2/lists/%d/contacts", listId), nil)
+}
+
+func (c Client) EachListContact(listId int, fn func(Contact) error) error {
+	return eachResource(c, fmt.Sprintf("/api/v2/lists/%d/contacts", listId), nil, fn)
+}
+
+func (c Client) DeleteContact(id int) error {
+	resp, err := c.doRequest("DELETE", fmt.Sprintf("/api/v2/contacts/%d", id), nil)
+	if err != nil {
+		return err
 	}
+	return resp.Body.Close()
+}
 
-	if len(contact.CustomFieldValues) > 0 {
-		// TextMagic API seems to refuse the update with a generic "not valid" error, so until we can find
-		// out what the problem is we'll fault it here instead.
-		return Contact{}, fmt.Errorf("can't create custom fields from the contact, use SetCustomFieldValue instead")
+// BlockContact stops TextMagic sending anything more to phone, e.g. when
+// they've asked us to.
+func (c Client) BlockContact(phone string) error {
+	resp, err := c.doRequestWithMap("POST", "/api/v2/contacts/block", map[string]string{"phone": phone})
+	if err != nil {
+		return err
 	}
+	return resp.Body.Close()
+}
+
+func (c Client) CreateContact(contact Contact) (Contact, error) {
+	request := newContactRequest(contact)
+	request.Type = -1
 
 	body, err := json.Marshal(request)
 	if err != nil {
@@ -359,47 +531,7 @@ func (c Client) CreateContact(contact Contact) (Contact, error) {
 }
 
 func (c Client) UpdateContact(contact Contact) error {
-	type updateContactRequestCustomFieldValue struct {
-		Id    int    `json:"id"`
-		Value string `json:"value"`
-	}
-	type updateContactRequest struct {
-		FirstName         string                                 `json:"firstName,omitempty"`
-		LastName          string                                 `json:"lastName,omitempty"`
-		CompanyName       string                                 `json:"companyName,omitempty"`
-		Phone             string                                 `json:"phone"`
-		Email             string                                 `json:"email"`
-		Favorited         bool                                   `json:"favorited"`
-		Blocked           bool                                   `json:"blocked"`
-		Type              int                                    `json:"type"`
-		Lists             string                                 `json:"lists"`
-		CustomFieldValues []updateContactRequestCustomFieldValue `json:"customFieldValues,omitempty"`
-		//Local             int    `json:"local"` // FIXME: Add option to allow local number specificiation?
-		//Country           string `json:"country"`
-	}
-
-	if len(contact.CustomFieldValues) > 0 {
-		// TextMagic API seems to refuse the update with a generic "not valid" error, so until we can find
-		// out what the problem is we'll fault it here instead.
-		return fmt.Errorf("can't update custom fields from the contact, use SetCustomFieldValue instead")
-	}
-
-	request := updateContactRequest{
-		FirstName:   contact.FirstName,
-		LastName:    contact.LastName,
-		CompanyName: contact.CompanyName,
-		Phone:       contact.Phone,
-		Email:       contact.Email,
-	}
-	for _, list := range contact.Lists {
-		if request.Lists != "" {
-			request.Lists = fmt.Sprintf("%s,%d", request.Lists, list.Id)
-		} else {
-			request.Lists = fmt.Sprintf("%d", list.Id)
-		}
-	}
-
-	body, err := json.Marshal(request)
+	body, err := json.Marshal(newContactRequest(contact))
 	if err != nil {
 		return err
 	}
@@ -418,6 +550,8 @@ type MessageToContacts struct {
 	Text     string
 	Contacts []Contact
 	SendAt   time.Time
+	// Sender ID or number, or "" for the account's default
+	From string
 }
 
 type Message struct {
@@ -441,36 +575,56 @@ type Message struct {
 	Resources       string `json:"resources,omitempty"`
 }
 
+// SendResult says what TextMagic made of a message we sent: a single message,
+// a session of messages to several recipients, a bulk session which is still
+// being worked through, or a schedule to send later. Only the relevant IDs
+// are set.
+type SendResult struct {
+	MessageId  int
+	SessionId  int
+	BulkId     int
+	ScheduleId int
+}
+
 func (c Client) SendMessageToContacts(m MessageToContacts) (int, error) {
-	fm := Message{Text: m.Text}
+	result, err := c.SendToContacts(m)
+	if result.MessageId != 0 {
+		return result.MessageId, err
+	} else {
+		return result.ScheduleId, err
+	}
+}
+
+func (c Client) SendToContacts(m MessageToContacts) (SendResult, error) {
+	fm := Message{Text: m.Text, From: m.From}
+	var ids []int
 	for _, contact := range m.Contacts {
-		if fm.Contacts != "" {
-			fm.Contacts += ","
-		}
-		fm.Contacts += fmt.Sprintf("%d", contact.Id)
+		ids = append(ids, contact.Id)
 	}
+	fm.Contacts = joinIds(ids)
 	if m.SendAt.After(time.Now()) {
 		zone, _ := m.SendAt.Zone()
 		fm.SendingDateTime = m.SendAt.Format("2006-01-02 15:04:05")
 		fm.SendingTimeZone = zone
 	}
-	messageId, _, _, scheduleId, err := c.SendMessage(fm)
-	if messageId != 0 {
-		return messageId, err
-	} else {
-		return scheduleId, err
-	}
+	return c.Send(fm)
 }
 
 func (c Client) SendMessage(message Message) (messageId, sessionId, bulkId, scheduleId int, err error) {
+	result, err := c.Send(message)
+	return result.MessageId, result.SessionId, result.BulkId, result.ScheduleId, err
+}
+
+func (c Client) Send(message Message) (SendResult, error) {
 	body, err := json.Marshal(message)
 	if err != nil {
-		return 0, 0, 0, 0, err
+		return SendResult{}, err
 	}
 	resp, err := c.doRequest("POST", "/api/v2/messages", body)
 	if err != nil {
-		return 0, 0, 0, 0, err
+		return SendResult{}, err
 	}
+	defer resp.Body.Close()
 	var response struct {
 		Id         int    `json:"id"`
 		Href       string `json:"href"`
@@ -481,7 +635,7 @@ func (c Client) SendMessage(message Message) (messageId, sessionId, bulkId, sche
 		MessageId  int    `json:"messageId"`
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
-		return 0, 0, 0, 0, err
+		return SendResult{}, err
 	}
-	return response.MessageId, response.SessionId, response.BulkId, response.ScheduleId, nil
+	return SendResult{response.MessageId, response.SessionId, response.BulkId, response.ScheduleId}, nil
 }
@@ -0,0 +1,130 @@
+package textmagic
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// readJSON decodes a file from testdata, so two bodies can be compared
+// regardless of formatting.
+func readJSON(t *testing.T, file string) interface{} {
+	t.Helper()
+	raw, err := os.ReadFile("testdata/" + file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		t.Fatalf("%s: %v", file, err)
+	}
+	return v
+}
+
+// fakeEndpoint is a TextMagic which expects one request, checks its body
+// against the JSON in wantFile, and answers with responseFile.
+func fakeEndpoint(t *testing.T, method, path, wantFile, responseFile string) *Client {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method || r.URL.Path != path {
+			t.Errorf("got %s %s, want %s %s", r.Method, r.URL.Path, method, path)
+			http.NotFound(w, r)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got interface{}
+		if err := json.Unmarshal(body, &got); err != nil {
+			t.Errorf("couldn't decode request: %v", err)
+		}
+		if want := readJSON(t, wantFile); !reflect.DeepEqual(got, want) {
+			t.Errorf("sent %s\nwant %v", body, want)
+		}
+		response, err := os.ReadFile("testdata/" + responseFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(response)
+	}))
+	t.Cleanup(server.Close)
+	return &Client{Http: server.Client(), Base: server.URL, Username: "test", ApiKey: "test"}
+}
+
+func TestCreateContact(t *testing.T) {
+	client := fakeEndpoint(t, "POST", "/api/v2/contacts/normalized", "contact-create-request.json", "contact-created.json")
+	contact, err := client.CreateContact(Contact{
+		FirstName:         "Doris",
+		LastName:          "Rodríguez",
+		Phone:             "447700900123",
+		Email:             "doris@example.com",
+		Lists:             []List{{Id: 7}, {Id: 9}},
+		CustomFieldValues: []CustomFieldValue{{Id: 11, Value: "Agar Street"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contact.Id != 4271917 {
+		t.Errorf("Id = %d, want 4271917", contact.Id)
+	}
+}
+
+// Updating a contact we've fetched sends back everything we'd got, with our
+// changes, and doesn't lose that they've been blocked.
+func TestUpdateContact(t *testing.T) {
+	var contact Contact
+	raw, err := os.ReadFile("testdata/contact.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(raw, &contact); err != nil {
+		t.Fatal(err)
+	}
+	if !contact.Blocked {
+		t.Fatal("blocked contact decoded as unblocked")
+	}
+
+	contact.Email = "doris.rodriguez@example.com"
+	contact = contact.SetCustomFieldValue(CustomField{Id: 12}, "2024-02-10")
+	client := fakeEndpoint(t, "PUT", "/api/v2/contacts/4271917", "contact-update-request.json", "contact-created.json")
+	if err := client.UpdateContact(contact); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetCustomFieldValue(t *testing.T) {
+	client := fakeEndpoint(t, "PUT", "/api/v2/customfields/12/update", "custom-field-update-request.json", "custom-field-updated.json")
+	if err := client.SetCustomFieldValue(12, 4271917, "2024-02-10"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestContactSetCustomFieldValue(t *testing.T) {
+	contact := Contact{CustomFieldValues: []CustomFieldValue{{Id: 11, Value: "Agar Street"}, {Id: 12, Value: "2023-11-04"}}}
+
+	updated := contact.SetCustomFieldValue(CustomField{Id: 12}, "2024-02-10")
+	want := []CustomFieldValue{{Id: 11, Value: "Agar Street"}, {Id: 12, Value: "2024-02-10"}}
+	if !reflect.DeepEqual(updated.CustomFieldValues, want) {
+		t.Errorf("updating existing value gave %v, want %v", updated.CustomFieldValues, want)
+	}
+
+	added := updated.SetCustomFieldValue(CustomField{Id: 13}, "2")
+	want = append(want, CustomFieldValue{Id: 13, Value: "2"})
+	if !reflect.DeepEqual(added.CustomFieldValues, want) {
+		t.Errorf("adding value gave %v, want %v", added.CustomFieldValues, want)
+	}
+
+	if value, _ := contact.CustomFieldValue(12); value != "2023-11-04" {
+		t.Errorf("original contact changed to %q", value)
+	}
+	if value, _ := updated.CustomFieldValue(13); value != "" {
+		t.Errorf("adding to a copy changed the contact it came from")
+	}
+}
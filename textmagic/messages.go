@@ -0,0 +1,88 @@
+package textmagic
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// SentMessage is an outbound message, as TextMagic lists them.
+type SentMessage struct {
+	Id          int               `json:"id"`
+	ContactId   int               `json:"contactId"`
+	SessionId   int               `json:"sessionId"`
+	Receiver    string            `json:"receiver"`
+	MessageTime AlmostRFC3339Time `json:"messageTime"`
+	Status      string            `json:"status"`
+	Text        string            `json:"text"`
+	Charset     string            `json:"charset"`
+	FirstName   string            `json:"firstName"`
+	LastName    string            `json:"lastName"`
+	Country     string            `json:"country"`
+	Sender      string            `json:"sender"`
+	Price       float64           `json:"price"`
+	PartsCount  int               `json:"partsCount"`
+}
+
+// Reply is an inbound message.
+type Reply struct {
+	Id          int               `json:"id"`
+	ContactId   int               `json:"contactId"`
+	Sender      string            `json:"sender"`
+	Receiver    string            `json:"receiver"`
+	MessageTime AlmostRFC3339Time `json:"messageTime"`
+	Text        string            `json:"text"`
+	FirstName   string            `json:"firstName"`
+	LastName    string            `json:"lastName"`
+}
+
+func (c Client) GetMessages() ([]SentMessage, error) {
+	return allResources[SentMessage](c, "/api/v2/messages", nil)
+}
+
+func (c Client) EachMessage(fn func(SentMessage) error) error {
+	return eachResource(c, "/api/v2/messages", nil, fn)
+}
+
+func (c Client) GetReplies() ([]Reply, error) {
+	return allResources[Reply](c, "/api/v2/replies", nil)
+}
+
+func (c Client) EachReply(fn func(Reply) error) error {
+	return eachResource(c, "/api/v2/replies", nil, fn)
+}
+
+// GetSessionMessages returns each message TextMagic sent for one session,
+// i.e. one SendMessage to several recipients.
+func (c Client) GetSessionMessages(sessionId int) ([]SentMessage, error) {
+	return allResources[SentMessage](c, fmt.Sprintf("/api/v2/sessions/%d/messages", sessionId), nil)
+}
+
+func (c Client) EachSessionMessage(sessionId int, fn func(SentMessage) error) error {
+	return eachResource(c, fmt.Sprintf("/api/v2/sessions/%d/messages", sessionId), nil, fn)
+}
+
+// BulkSession is a large send which TextMagic works through in the
+// background. Once it's done, its messages are in Session.
+type BulkSession struct {
+	Id             int    `json:"id"`
+	Status         string `json:"status"`
+	ItemsProcessed int    `json:"itemsProcessed"`
+	ItemsTotal     int    `json:"itemsTotal"`
+	Text           string `json:"text"`
+	Session        *struct {
+		Id int `json:"id"`
+	} `json:"session"`
+}
+
+func (c Client) GetBulkSession(bulkId int) (BulkSession, error) {
+	resp, err := c.doRequest("GET", fmt.Sprintf("/api/v2/bulks/%d", bulkId), nil)
+	if err != nil {
+		return BulkSession{}, err
+	}
+	defer resp.Body.Close()
+	var bulk BulkSession
+	if err := json.NewDecoder(resp.Body).Decode(&bulk); err != nil {
+		return BulkSession{}, err
+	}
+	return bulk, nil
+}
@@ -0,0 +1,78 @@
+package textmagic
+
+import (
+	"encoding/json"
+	"net/url"
+	"strconv"
+)
+
+// How many resources we ask for at once. TextMagic may return fewer, so we
+// always follow pageCount rather than assume.
+const pageLimit = 100
+
+// Return ErrStop from a callback passed to one of the Each... methods to stop
+// early, without an error.
+var ErrStop = ErrorFixed("stop")
+
+// Page is the envelope TextMagic wraps around every list of resources.
+type Page[T any] struct {
+	Page      int `json:"page"`
+	PageCount int `json:"pageCount"`
+	Limit     int `json:"limit"`
+	Resources []T `json:"resources"`
+}
+
+func getPage[T any](c Client, endpoint string, query url.Values, page int) (Page[T], error) {
+	q := url.Values{}
+	for key, values := range query {
+		q[key] = values
+	}
+	q.Set("page", strconv.Itoa(page))
+	q.Set("limit", strconv.Itoa(pageLimit))
+
+	resp, err := c.doRequest("GET", endpoint+"?"+q.Encode(), nil)
+	if err != nil {
+		return Page[T]{}, err
+	}
+	defer resp.Body.Close()
+
+	var response Page[T]
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return Page[T]{}, err
+	}
+	return response, nil
+}
+
+// eachResource calls fn for every resource from a list endpoint, fetching
+// each page only once we've got through the previous one.
+func eachResource[T any](c Client, endpoint string, query url.Values, fn func(T) error) error {
+	for page := 1; ; page++ {
+		response, err := getPage[T](c, endpoint, query, page)
+		if err != nil {
+			return err
+		}
+		for _, resource := range response.Resources {
+			if err := fn(resource); err == ErrStop {
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+		if page >= response.PageCount || len(response.Resources) == 0 {
+			return nil
+		}
+	}
+}
+
+// allResources collects every resource from a list endpoint.
+func allResources[T any](c Client, endpoint string, query url.Values) ([]T, error) {
+	var all []T
+	err := eachResource(c, endpoint, query, func(resource T) error {
+		all = append(all, resource)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return all, nil
+}
@@ -0,0 +1,78 @@
+package textmagic
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+type Template struct {
+	Id           int               `json:"id"`
+	Name         string            `json:"name"`
+	Content      string            `json:"content"`
+	LastModified AlmostRFC3339Time `json:"lastModified"`
+}
+
+func (c Client) GetTemplates() ([]Template, error) {
+	return allResources[Template](c, "/api/v2/templates", nil)
+}
+
+func (c Client) EachTemplate(fn func(Template) error) error {
+	return eachResource(c, "/api/v2/templates", nil, fn)
+}
+
+func (c Client) GetTemplate(id int) (Template, error) {
+	resp, err := c.doRequest("GET", fmt.Sprintf("/api/v2/templates/%d", id), nil)
+	if err != nil {
+		return Template{}, err
+	}
+	defer resp.Body.Close()
+	var template Template
+	if err := json.NewDecoder(resp.Body).Decode(&template); err != nil {
+		return Template{}, err
+	}
+	return template, nil
+}
+
+// GetTemplateByName returns the first template called name, or ErrNotFound.
+func (c Client) GetTemplateByName(name string) (found Template, err error) {
+	err = c.EachTemplate(func(t Template) error {
+		if t.Name == name {
+			found = t
+			return ErrStop
+		}
+		return nil
+	})
+	if err == nil && found.Id == 0 {
+		err = ErrNotFound
+	}
+	return found, err
+}
+
+func (c Client) CreateTemplate(name, content string) (Template, error) {
+	resp, err := c.doRequestWithMap("POST", "/api/v2/templates", map[string]string{"name": name, "content": content})
+	if err != nil {
+		return Template{}, err
+	}
+	defer resp.Body.Close()
+	var response createdResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return Template{}, err
+	}
+	return Template{Id: response.Id, Name: name, Content: content}, nil
+}
+
+func (c Client) UpdateTemplate(t Template) error {
+	resp, err := c.doRequestWithMap("PUT", fmt.Sprintf("/api/v2/templates/%d", t.Id), map[string]string{"name": t.Name, "content": t.Content})
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (c Client) DeleteTemplate(id int) error {
+	resp, err := c.doRequest("DELETE", fmt.Sprintf("/api/v2/templates/%d", id), nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
@@ -0,0 +1,176 @@
+package uplisting
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+/*
+   {
+     "calendar": {
+       "property_id": 7458,
+       "days": [
+         {
+           "date": "2023-12-01",
+           "available": true,
+           "day_rate": 95.0,
+           "minimum_length_of_stay": 2,
+           "closed_for_arrival": false,
+           "closed_for_departure": false
+         },
+         ...
+       ]
+     }
+   }
+*/
+
+// CalendarDay is one night at a property: whether it's free, and what it
+// costs. Uplisting's calendar is where nightly rates come from.
+type CalendarDay struct {
+	Date                string  `json:"date"`
+	Available           bool    `json:"available"`
+	DayRate             float64 `json:"day_rate"`
+	MinimumLengthOfStay int     `json:"minimum_length_of_stay"`
+	ClosedForArrival    bool    `json:"closed_for_arrival"`
+	ClosedForDeparture  bool    `json:"closed_for_departure"`
+}
+
+func (d CalendarDay) Time() time.Time {
+	tm, _ := time.Parse("2006-01-02", d.Date)
+	return tm
+}
+
+// GetCalendar returns each day at a property from from to to, inclusive.
+func (c *Client) GetCalendar(p Property, from time.Time, to time.Time) ([]CalendarDay, error) {
+	uri := fmt.Sprintf("/calendar/%s?from=%s&to=%s", p.ID, from.Format("2006-01-02"), to.Format("2006-01-02"))
+	resp, err := c.doRequest(uri, map[string]string{})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var response struct {
+		Calendar struct {
+			PropertyID int           `json:"property_id"`
+			Days       []CalendarDay `json:"days"`
+		} `json:"calendar"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, err
+	}
+	return response.Calendar.Days, nil
+}
+
+// Rate is the price of a night at a property, and the shortest stay which
+// can start then.
+type Rate struct {
+	Date                string  `json:"date"`
+	DayRate             float64 `json:"day_rate"`
+	MinimumLengthOfStay int     `json:"minimum_length_of_stay,omitempty"`
+}
+
+// GetRates returns the rate for each night at a property from from to to,
+// inclusive, whether or not it's available. Uplisting keeps rates in the
+// calendar, so this is the calendar without the availability.
+func (c *Client) GetRates(p Property, from time.Time, to time.Time) ([]Rate, error) {
+	days, err := c.GetCalendar(p, from, to)
+	if err != nil {
+		return nil, err
+	}
+	rates := make([]Rate, len(days))
+	for i, day := range days {
+		rates[i] = Rate{day.Date, day.DayRate, day.MinimumLengthOfStay}
+	}
+	return rates, nil
+}
+
+// SetRates changes the rates of some nights at a property. A zero minimum
+// stay leaves it as it was.
+func (c *Client) SetRates(p Property, rates []Rate) error {
+	var body struct {
+		Calendar struct {
+			Days []Rate `json:"days"`
+		} `json:"calendar"`
+	}
+	body.Calendar.Days = rates
+	req, err := c.requestWithBody("PUT", "/calendar/"+p.ID, body)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Availability is a property that's free for a stay, and its rate for each
+// night.
+type Availability struct {
+	Property Property
+	Nights   []CalendarDay
+}
+
+// Total is what the nights cost, before cleaning and any other fees.
+func (a Availability) Total() (total float64) {
+	for _, night := range a.Nights {
+		total += night.DayRate
+	}
+	return total
+}
+
+// free checks a property's calendar, from arrival to departure, for a stay:
+// every night available, arrival and departure allowed on those days, and
+// long enough for the minimum stay. It returns the nights if so.
+func free(days []CalendarDay, arrival, departure time.Time) ([]CalendarDay, bool) {
+	byDate := make(map[string]CalendarDay)
+	for _, day := range days {
+		byDate[day.Date] = day
+	}
+	var nights []CalendarDay
+	for date := arrival; date.Before(departure); date = date.AddDate(0, 0, 1) {
+		night, ok := byDate[date.Format("2006-01-02")]
+		if !ok || !night.Available {
+			return nil, false
+		}
+		nights = append(nights, night)
+	}
+	if len(nights) == 0 || nights[0].ClosedForArrival || len(nights) < nights[0].MinimumLengthOfStay {
+		return nil, false
+	}
+	if last, ok := byDate[departure.Format("2006-01-02")]; ok && last.ClosedForDeparture {
+		return nil, false
+	}
+	return nights, true
+}
+
+// FreeProperties finds which properties are free for a stay arriving on
+// arrival and leaving on departure, with their nightly rates. If property
+// isn't nil, only that one is checked.
+func (c *Client) FreeProperties(arrival, departure time.Time, property *Property) ([]Availability, error) {
+	if !departure.After(arrival) {
+		return nil, fmt.Errorf("departure %s isn't after arrival %s", departure.Format("2006-01-02"), arrival.Format("2006-01-02"))
+	}
+	properties := []Property{}
+	if property != nil {
+		properties = append(properties, *property)
+	} else {
+		var err error
+		if properties, err = c.GetProperties(); err != nil {
+			return nil, err
+		}
+	}
+
+	var available []Availability
+	for _, p := range properties {
+		days, err := c.GetCalendar(p, arrival, departure)
+		if err != nil {
+			return nil, fmt.Errorf("calendar for %s: %w", p.Name, err)
+		}
+		if nights, ok := free(days, arrival, departure); ok {
+			available = append(available, Availability{Property: p, Nights: nights})
+		}
+	}
+	return available, nil
+}
@@ -83,32 +83,75 @@ type Property struct {
    "status": "needs_check_in"
 */
 
+// BookingStatus is where a booking is up to.
+type BookingStatus string
+
+const (
+	StatusNeedsCheckIn BookingStatus = "needs_check_in"
+	StatusCheckedIn    BookingStatus = "checked_in"
+	StatusCheckedOut   BookingStatus = "checked_out"
+	StatusCancelled    BookingStatus = "cancelled"
+)
+
+// Channel is where a booking was made. Bookings made on our own site come
+// through Uplisting itself.
+type Channel string
+
+const (
+	ChannelUplisting     Channel = "uplisting"
+	ChannelAirbnb        Channel = "airbnb"
+	ChannelBookingDotCom Channel = "booking_dot_com"
+	ChannelHomeAway      Channel = "home_away"
+	ChannelExpedia       Channel = "expedia"
+)
+
+// Booking is the whole of Uplisting's booking, as above. Fields which are
+// null in Uplisting are left empty.
 type Booking struct {
-	ID                         int     `json:"id"`
-	Currency                   string  `json:"currency"`
-	PropertyName               string  `json:"property_name"`
-	PropertyID                 int     `json:"property_id"`
-	CheckIn                    string  `json:"check_in"`
-	CheckOut                   string  `json:"check_out"`
-	ArrivalTime                string  `json:"arrival_time"`
-	DepartureTime              string  `json:"departure_time"`
-	NumberOfNights             int     `json:"number_of_nights"`
-	GuestName                  string  `json:"guest_name"`
-	GuestEmail                 string  `json:"guest_email"`
-	GuestPhone                 string  `json:"guest_phone"`
-	Status                     string  `json:"status"`
-	Channel                    string  `json:"channel"`
-	ExternalReservationID      string  `json:"external_reservation_id"`
-	NumberOfGuests             int     `json:"number_of_guests"`
-	AccomodationTotal          float64 `json:"accomodation_total"`
-	CleaningFee                float64 `json:"cleaning_fee"`
-	Commission                 float64 `json:"commission"`
-	OtherCharges               float64 `json:"other_charges"`
-	TotalPayout                float64 `json:"total_payout"`
-	AccommodationManagementFee float64 `json:"accommodation_management_fee"`
-	CleaningManagementFee      float64 `json:"cleaning_management_fee"`
-	TotalManagementFee         float64 `json:"total_management_fee"`
-	BookedAt                   string  `json:"booked_at"`
+	ID                         int           `json:"id"`
+	Currency                   string        `json:"currency"`
+	PropertyName               string        `json:"property_name"`
+	PropertyID                 int           `json:"property_id"`
+	MultiUnitName              string        `json:"multi_unit_name"`
+	MultiUnitID                int           `json:"multi_unit_id"`
+	CheckIn                    string        `json:"check_in"`
+	CheckOut                   string        `json:"check_out"`
+	ArrivalTime                string        `json:"arrival_time"`
+	DepartureTime              string        `json:"departure_time"`
+	NumberOfNights             int           `json:"number_of_nights"`
+	ManuallyMoved              bool          `json:"manually_moved"`
+	GuestName                  string        `json:"guest_name"`
+	PreferredGuestName         string        `json:"preferred_guest_name"`
+	GuestEmail                 string        `json:"guest_email"`
+	GuestPhone                 string        `json:"guest_phone"`
+	Status                     BookingStatus `json:"status"`
+	Channel                    Channel       `json:"channel"`
+	Source                     string        `json:"source"`
+	Direct                     bool          `json:"direct"`
+	Note                       string        `json:"note"`
+	AutomatedMessagesEnabled   bool          `json:"automated_messages_enabled"`
+	AutomatedReviewsEnabled    bool          `json:"automated_reviews_enabled"`
+	ExternalReservationID      string        `json:"external_reservation_id"`
+	NumberOfGuests             int           `json:"number_of_guests"`
+	AccomodationTotal          float64       `json:"accomodation_total"`
+	CleaningFee                float64       `json:"cleaning_fee"`
+	ExtraGuestCharges          float64       `json:"extra_guest_charges"`
+	ExtraCharges               float64       `json:"extra_charges"`
+	Discounts                  float64       `json:"discounts"`
+	BookingTaxes               float64       `json:"booking_taxes"`
+	Commission                 float64       `json:"commission"`
+	CommissionVAT              float64       `json:"commission_vat"`
+	OtherCharges               float64       `json:"other_charges"`
+	TotalPayout                float64       `json:"total_payout"`
+	CancellationFee            float64       `json:"cancellation_fee"`
+	GrossRevenue               float64       `json:"gross_revenue"`
+	AccommodationManagementFee float64       `json:"accommodation_management_fee"`
+	CleaningManagementFee      float64       `json:"cleaning_management_fee"`
+	TotalManagementFee         float64       `json:"total_management_fee"`
+	PaymentProcessingFee       float64       `json:"payment_processing_fee"`
+	NetRevenue                 float64       `json:"net_revenue"`
+	Balance                    float64       `json:"balance"`
+	BookedAt                   string        `json:"booked_at"`
 }
 
 func (b Booking) ArrivalAt() time.Time {
@@ -121,28 +164,42 @@ func (b Booking) DepartureAt() time.Time {
 	return tm
 }
 
+// BookedAtTime is when the guest made the booking.
+func (b Booking) BookedAtTime() time.Time {
+	tm, _ := time.Parse(time.RFC3339, b.BookedAt)
+	return tm
+}
+
 func (c *Client) request(endpoint string, keys map[string]string) (*http.Request, error) {
-	body, err := json.Marshal(keys)
+	return c.requestWithBody("GET", endpoint, keys)
+}
+
+// requestWithBody is a request with any JSON body, for the endpoints which
+// change things.
+func (c *Client) requestWithBody(method string, endpoint string, v any) (*http.Request, error) {
+	body, err := json.Marshal(v)
 	if err != nil {
 		return nil, err
 	}
-	req, err := http.NewRequest("GET", c.Base+endpoint, bytes.NewReader(body))
+	req, err := http.NewRequest(method, c.Base+endpoint, bytes.NewReader(body))
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Add("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(c.Key)))
 	req.Header.Add("Accept", "application/json; charset=utf-8")
+	if method != "GET" {
+		req.Header.Add("Content-Type", "application/json; charset=utf-8")
+	}
 	return req, nil
 }
 
 func (c *Client) do(req *http.Request) (*http.Response, error) {
 	resp, err := c.Http.Do(req)
-	//fmt.Println(req)
-	//fmt.Println(resp)
 	if err != nil {
 		return nil, err
 	}
-	if resp.StatusCode != 200 {
+	// Changes can come back 201 or 204, so anything 2xx is fine
+	if resp.StatusCode/100 != 2 {
 		var respError [500]byte
 		_, err := resp.Body.Read(respError[:])
 		if err != nil {
@@ -208,13 +265,11 @@ func (c *Client) GetBookings(p Property, from time.Time, to time.Time) (bookings
 		}
 		bookings = append(bookings, bookingsPage...)
 	}
-	fmt.Println(bookings)
 	return bookings, nil
 }
 
 func (c *Client) GetBookingsPage(p Property, from time.Time, to time.Time, page int) (bookings []Booking, totalBookings int, totalPages int, e error) {
 	uri := fmt.Sprintf("/bookings/%s?from=%s&to=%s&page=%d", p.ID, from.Format("2006-01-02"), to.Format("2006-01-02"), page)
-	fmt.Println(uri)
 	resp, err := c.doRequest(uri, map[string]string{})
 	if err != nil {
 		return nil, 0, 0, err
@@ -234,3 +289,23 @@ func (c *Client) GetBookingsPage(p Property, from time.Time, to time.Time, page
 
 	return response.Bookings, response.Meta.Total, response.Meta.TotalPages, nil
 }
+
+// GetBooking returns one booking by its ID.
+func (c *Client) GetBooking(id int) (Booking, error) {
+	resp, err := c.doRequest(fmt.Sprintf("/bookings/%d/show", id), map[string]string{})
+	if err != nil {
+		return Booking{}, err
+	}
+	defer resp.Body.Close()
+
+	var response struct {
+		Booking Booking `json:"booking"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return Booking{}, err
+	}
+	if response.Booking.ID == 0 {
+		return Booking{}, fmt.Errorf("no booking %d", id)
+	}
+	return response.Booking, nil
+}
@@ -0,0 +1,136 @@
+package uplisting
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGetBooking(t *testing.T) {
+	fixture, err := os.ReadFile("testdata/booking.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/bookings/2693371/show" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(fixture)
+	}))
+	defer server.Close()
+	client := &Client{Http: server.Client(), Base: server.URL, Key: "key"}
+
+	b, err := client.GetBooking(2693371)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.ID != 2693371 || b.Channel != ChannelBookingDotCom || b.Status != StatusNeedsCheckIn {
+		t.Errorf("decoded %d %s %s", b.ID, b.Channel, b.Status)
+	}
+	if b.PreferredGuestName != "" || b.MultiUnitID != 0 || b.CancellationFee != 0 {
+		t.Errorf("nulls decoded as %q, %d, %v", b.PreferredGuestName, b.MultiUnitID, b.CancellationFee)
+	}
+	if b.GrossRevenue != 628.85 || b.NetRevenue != 429.87 || b.TotalPayout != 526.34 {
+		t.Errorf("revenue decoded as %v, %v, %v", b.GrossRevenue, b.NetRevenue, b.TotalPayout)
+	}
+	if want := time.Date(2023, 11, 4, 11, 0, 0, 0, time.UTC); !b.DepartureAt().Equal(want) {
+		t.Errorf("DepartureAt = %s, want %s", b.DepartureAt(), want)
+	}
+
+	if _, err := client.GetBooking(1); err == nil {
+		t.Error("got a booking that doesn't exist")
+	}
+}
+
+func TestFree(t *testing.T) {
+	day := func(date string, rate float64) CalendarDay {
+		return CalendarDay{Date: date, Available: true, DayRate: rate, MinimumLengthOfStay: 2}
+	}
+	days := []CalendarDay{
+		day("2023-12-01", 95),
+		day("2023-12-02", 110),
+		day("2023-12-03", 110),
+		day("2023-12-04", 95),
+		{Date: "2023-12-05", Available: false},
+		day("2023-12-06", 95),
+	}
+	days[3].ClosedForArrival = true
+	date := func(s string) time.Time {
+		tm, _ := time.Parse("2006-01-02", s)
+		return tm
+	}
+
+	tests := []struct {
+		name, arrival, departure string
+		total                    float64
+		ok                       bool
+	}{
+		{"free", "2023-12-01", "2023-12-04", 315, true},
+		{"too short", "2023-12-02", "2023-12-03", 0, false},
+		{"booked night", "2023-12-03", "2023-12-06", 0, false},
+		{"closed for arrival", "2023-12-04", "2023-12-06", 0, false},
+		{"past the calendar", "2023-12-06", "2023-12-08", 0, false},
+	}
+	for _, test := range tests {
+		nights, ok := free(days, date(test.arrival), date(test.departure))
+		total := Availability{Nights: nights}.Total()
+		if ok != test.ok || total != test.total {
+			t.Errorf("%s: free = %v with total %v, want %v with %v", test.name, ok, total, test.ok, test.total)
+		}
+	}
+}
+
+func TestRates(t *testing.T) {
+	var put []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/calendar/7458" {
+			http.NotFound(w, r)
+			return
+		}
+		switch r.Method {
+		case "GET":
+			if r.URL.Query().Get("from") != "2023-12-01" || r.URL.Query().Get("to") != "2023-12-02" {
+				t.Errorf("asked for %s", r.URL.RawQuery)
+			}
+			w.Write([]byte(`{"calendar":{"property_id":7458,"days":[
+				{"date":"2023-12-01","available":false,"day_rate":95.0,"minimum_length_of_stay":2},
+				{"date":"2023-12-02","available":true,"day_rate":110.0,"minimum_length_of_stay":3}]}}`))
+		case "PUT":
+			if r.Header.Get("Content-Type") != "application/json; charset=utf-8" {
+				t.Errorf("sent %q", r.Header.Get("Content-Type"))
+			}
+			put, _ = io.ReadAll(r.Body)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer server.Close()
+	client := &Client{Http: server.Client(), Base: server.URL, Key: "key"}
+	p := Property{ID: "7458"}
+
+	rates, err := client.GetRates(p, time.Date(2023, 12, 1, 0, 0, 0, 0, time.UTC), time.Date(2023, 12, 2, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Booked nights still have a rate
+	want := []Rate{{"2023-12-01", 95, 2}, {"2023-12-02", 110, 3}}
+	if !reflect.DeepEqual(rates, want) {
+		t.Errorf("got %v, want %v", rates, want)
+	}
+
+	if err := client.SetRates(p, []Rate{{Date: "2023-12-02", DayRate: 99.5}}); err != nil {
+		t.Fatal(err)
+	}
+	if string(put) != `{"calendar":{"days":[{"date":"2023-12-02","day_rate":99.5}]}}` {
+		t.Errorf("sent %s", put)
+	}
+
+	if err := client.SetRates(Property{ID: "1"}, nil); err == nil {
+		t.Error("set rates at a property that doesn't exist")
+	}
+}
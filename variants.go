@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+)
+
+/* A template can have variants for A/B testing, e.g. RECENT_B alongside
+ * RECENT, each with a weight:
+ *
+ *   TEMPLATE_VARIANTS=RECENT:70,RECENT_B:30
+ *
+ * The variant's text is in TEMPLATE_RECENT_B, or the TextMagic template
+ * "Rebook: RECENT_B". Each guest always gets the same variant of a template,
+ * chosen by a hash of their phone number. Variant names are upper case, so
+ * they can't be mistaken for translations like RECENT_fr.
+ */
+
+type templateVariant struct {
+	name   string
+	weight int
+}
+
+// baseTemplate is the template a variant belongs to, e.g. RECENT for
+// RECENT_B.
+func baseTemplate(variant string) string {
+	base, _, _ := strings.Cut(variant, "_")
+	return base
+}
+
+// parseTemplateVariants reads TEMPLATE_VARIANTS into the variants of each
+// template. Templates that aren't mentioned just have themselves.
+func parseTemplateVariants(entries []string) (map[string][]templateVariant, error) {
+	variants := make(map[string][]templateVariant)
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, weightRaw, ok := strings.Cut(entry, ":")
+		if !ok {
+			weightRaw = "1"
+		}
+		weight, err := strconv.Atoi(weightRaw)
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("TEMPLATE_VARIANTS: bad weight in %q", entry)
+		}
+		base := baseTemplate(name)
+		known := false
+		for _, t := range templateNames {
+			known = known || t == base
+		}
+		if !known {
+			return nil, fmt.Errorf("TEMPLATE_VARIANTS: %q isn't a variant of %s", name, strings.Join(templateNames, ", "))
+		}
+		// Translations are named like RECENT_fr, so a lower-case variant
+		// would share its text with one.
+		if name != strings.ToUpper(name) {
+			return nil, fmt.Errorf("TEMPLATE_VARIANTS: %q looks like a translation, variant names are upper case", name)
+		}
+		variants[base] = append(variants[base], templateVariant{name, weight})
+	}
+	for base, vs := range variants {
+		total := 0
+		for _, v := range vs {
+			total += v.weight
+		}
+		if total == 0 {
+			return nil, fmt.Errorf("TEMPLATE_VARIANTS: variants of %s all have zero weight", base)
+		}
+	}
+	return variants, nil
+}
+
+// variantNames is the base templates, and any extra variants.
+func variantNames(variants map[string][]templateVariant) []string {
+	names := append([]string(nil), templateNames...)
+	for _, base := range templateNames {
+		for _, v := range variants[base] {
+			names = appendUnique(names, v.name)
+		}
+	}
+	return names
+}
+
+// chooseVariant picks the variant of template for the guest with this phone
+// number. The same guest always gets the same variant, as long as the
+// weights don't change.
+func chooseVariant(variants map[string][]templateVariant, template, phone string) string {
+	vs := variants[template]
+	if len(vs) == 0 {
+		return template
+	}
+	total := 0
+	for _, v := range vs {
+		total += v.weight
+	}
+	h := fnv.New32a()
+	h.Write([]byte(template + ":" + phone))
+	n := int(h.Sum32() % uint32(total))
+	for _, v := range vs {
+		if n < v.weight {
+			return v.name
+		}
+		n -= v.weight
+	}
+	return vs[len(vs)-1].name
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTemplateVariants(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []string
+		want    map[string][]templateVariant
+		err     string
+	}{
+		{
+			name:    "weights",
+			entries: []string{"RECENT:70", " RECENT_B:30 ", "", "OLD_LONG"},
+			want: map[string][]templateVariant{
+				"RECENT": {{"RECENT", 70}, {"RECENT_B", 30}},
+				"OLD":    {{"OLD_LONG", 1}},
+			},
+		},
+		{
+			name:    "a variant switched off",
+			entries: []string{"RECENT:1", "RECENT_B:0"},
+			want:    map[string][]templateVariant{"RECENT": {{"RECENT", 1}, {"RECENT_B", 0}}},
+		},
+		{name: "nothing", want: map[string][]templateVariant{}},
+		{name: "bad weight", entries: []string{"RECENT_B:x"}, err: "bad weight"},
+		{name: "negative weight", entries: []string{"RECENT_B:-1"}, err: "bad weight"},
+		{name: "all zero", entries: []string{"RECENT:0", "RECENT_B:0"}, err: "all have zero weight"},
+		{name: "unknown template", entries: []string{"LAPSED_B:10"}, err: "isn't a variant of OLD, RECENT, DIRECT"},
+		{name: "a translation", entries: []string{"RECENT:50", "RECENT_fr:50"}, err: "looks like a translation"},
+		{name: "a translated variant", entries: []string{"RECENT_B_de:50"}, err: "looks like a translation"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseTemplateVariants(test.entries)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("got %v, want an error saying %q", err, test.err)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, %v, want %v", got, err, test.want)
+			}
+		})
+	}
+}
+
+func TestChooseVariant(t *testing.T) {
+	variants, err := parseTemplateVariants([]string{"RECENT:70", "RECENT_B:30", "OLD:1", "OLD_B:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := chooseVariant(variants, "DIRECT", "+447700900123"); got != "DIRECT" {
+		t.Errorf("a template without variants chose %s", got)
+	}
+
+	counts := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		phone := fmt.Sprintf("+4477009%05d", i)
+		variant := chooseVariant(variants, "RECENT", phone)
+		if again := chooseVariant(variants, "RECENT", phone); again != variant {
+			t.Fatalf("%s got %s then %s", phone, variant, again)
+		}
+		counts[variant]++
+		if old := chooseVariant(variants, "OLD", phone); old != "OLD" {
+			t.Fatalf("%s got %s, which has no weight", phone, old)
+		}
+	}
+	// Within a couple of percent of the weights
+	if counts["RECENT"] < 6800 || counts["RECENT"] > 7200 || counts["RECENT"]+counts["RECENT_B"] != 10000 {
+		t.Errorf("chose %v from 70:30", counts)
+	}
+}
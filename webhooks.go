@@ -0,0 +1,331 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+
+	"github.com/matthewbloch/text-guests/textmagic"
+	"github.com/matthewbloch/text-guests/uplisting"
+)
+
+/* Uplisting can tell us about bookings as they happen, rather than us
+ * waiting for the next run to find them. The daemon takes its webhooks at
+ * /webhooks/uplisting (or /webhooks/uplisting/<tenant>) once
+ * UPLISTING_WEBHOOK_SECRET is set. Each booking is kept in the state store,
+ * and the guest is looked at straight away, just as a run would: a checkout
+ * means they're due their thank-you at 7pm that evening.
+ */
+
+// The webhook events we understand; anything else is treated as an update.
+const (
+	bookingCreated    = "created"
+	bookingUpdated    = "updated"
+	bookingCancelled  = "cancelled"
+	bookingCheckedOut = "checked_out"
+)
+
+// Webhooks bigger than this are certainly not a booking.
+const maxWebhookSize = 1 << 20
+
+// webhookActions is the bookings we're still acting on after answering
+// Uplisting, so the daemon can let them finish before it exits.
+var webhookActions sync.WaitGroup
+
+// uplistingWebhookPayload is what we accept from Uplisting: the booking
+// wrapped up with the event, or just the booking on its own.
+type uplistingWebhookPayload struct {
+	Event   string             `json:"event"`
+	Type    string             `json:"type"`
+	Booking *uplisting.Booking `json:"booking"`
+	Data    *uplisting.Booking `json:"data"`
+}
+
+// normalizeBookingEvent turns "booking.checked_out", "Check out" and the
+// like into one of our events.
+func normalizeBookingEvent(event string) string {
+	event = strings.ToLower(strings.TrimSpace(event))
+	event = strings.NewReplacer(" ", "_", "-", "_", ".", "_").Replace(event)
+	event = strings.TrimPrefix(event, "booking_")
+	switch event {
+	case "created", "create", "new":
+		return bookingCreated
+	case "cancelled", "canceled", "cancel", "cancellation":
+		return bookingCancelled
+	case "checked_out", "check_out", "checkout":
+		return bookingCheckedOut
+	}
+	return bookingUpdated
+}
+
+// decodeUplistingWebhook reads the event and booking out of a webhook.
+func decodeUplistingWebhook(body []byte) (event string, booking uplisting.Booking, err error) {
+	var payload uplistingWebhookPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return "", booking, err
+	}
+	switch {
+	case payload.Booking != nil:
+		booking = *payload.Booking
+	case payload.Data != nil:
+		booking = *payload.Data
+	default:
+		if err := json.Unmarshal(body, &booking); err != nil {
+			return "", booking, err
+		}
+	}
+	if booking.ID == 0 {
+		return "", booking, errors.New("no booking ID")
+	}
+	event = payload.Event
+	if event == "" {
+		event = payload.Type
+	}
+	event = normalizeBookingEvent(event)
+	if event == bookingCancelled || booking.Status == uplisting.StatusCancelled {
+		event = bookingCancelled
+		booking.Status = uplisting.StatusCancelled
+	}
+	booking.GuestPhone = normalizePhone(booking.GuestPhone)
+	return event, booking, nil
+}
+
+// verifySignature checks a webhook's body was signed with secret: an
+// HMAC-SHA256, in hex or base64, optionally prefixed "sha256=".
+func verifySignature(secret string, body []byte, signature string) bool {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	expected := mac.Sum(nil)
+
+	signature = strings.TrimPrefix(strings.TrimSpace(signature), "sha256=")
+	if got, err := hex.DecodeString(signature); err == nil && hmac.Equal(got, expected) {
+		return true
+	}
+	got, err := base64.StdEncoding.DecodeString(signature)
+	return err == nil && hmac.Equal(got, expected)
+}
+
+// verifyUplistingWebhook checks a webhook came from Uplisting: signed with
+// our secret, or, for a sender that can't sign, with the secret itself as
+// the URL's token parameter.
+func (c config) verifyUplistingWebhook(r *http.Request, body []byte) bool {
+	if c.UplistingWebhookSecret == "" {
+		return false
+	}
+	if signature := r.Header.Get(c.UplistingWebhookSignatureHeader); signature != "" {
+		return verifySignature(c.UplistingWebhookSecret, body, signature)
+	}
+	token := r.URL.Query().Get("token")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(c.UplistingWebhookSecret)) == 1
+}
+
+// recordWebhookBooking keeps a booking from a webhook in the state store
+// straight away, so it isn't lost if we can't act on it.
+func recordWebhookBooking(config config, event string, booking uplisting.Booking) error {
+	webhooksTotal.inc("uplisting", event)
+	slog.Info("Uplisting webhook", "tenant", config.Tenant, "event", event, "booking", booking.ID, "property", booking.PropertyName, "phone", booking.GuestPhone)
+	store, err := openStore(config.StateFile)
+	if err != nil {
+		return fmt.Errorf("couldn't read %s: %w", config.StateFile, err)
+	}
+	store.recordBookings([]uplisting.Booking{booking})
+	return store.save()
+}
+
+// guestIdentity finds the identity a booking ended up in.
+func guestIdentity(identities []*identity, bookingId int) *identity {
+	for _, id := range identities {
+		for _, booking := range id.bookings {
+			if booking.ID == bookingId {
+				return id
+			}
+		}
+	}
+	return nil
+}
+
+// evaluateGuest does for one guest what a run does for everyone: brings
+// their contact up to date from every booking we know of, and texts them if
+// they're due it as of now.
+func evaluateGuest(config config, uplistingClient *uplisting.Client, textmagicClient *textmagic.Client, booking uplisting.Booking, now time.Time, report *runReport) error {
+	campaignLock.Lock()
+	defer campaignLock.Unlock()
+
+	state, _, err := prepareCampaign(config, uplistingClient, textmagicClient, report)
+	if err != nil {
+		return err
+	}
+	defer state.saveStore(config.StateFile)
+
+	identities, _ := resolveIdentities(activeBookings(state.store.bookings()), config.IdentityMinConfidence)
+	id := guestIdentity(identities, booking.ID)
+	if id == nil {
+		report.skip("booking not active")
+		return nil
+	}
+	g := state.findGuestContact(textmagicClient, id)
+	if g == nil {
+		return nil
+	}
+	if config.TextMagicPropertyListPrefix != "" {
+		for _, stay := range g.stays {
+			state.segments.add(config.TextMagicPropertyListPrefix+stay.PropertyName, g.contact.Id)
+		}
+	}
+	state.guests = []*guest{g}
+	report.add(func(r *runReport) { r.Guests = 1 })
+
+	var sends []pendingSend
+	if send, ok := state.prepareSend(config, g, now); ok {
+		sends = append(sends, send)
+	}
+	if err := state.completeSends(config, textmagicClient, sendIndividually(textmagicClient, sends), now); err != nil {
+		return err
+	}
+
+	if err := state.segments.flush(textmagicClient); err != nil {
+		slog.Error("Couldn't update guest lists:", "cause", err)
+		report.error("lists")
+	}
+	return nil
+}
+
+// actOnBooking looks at the guest again after news of their booking, unless
+// it's been cancelled.
+func actOnBooking(config config, uplistingClient *uplisting.Client, textmagicClient *textmagic.Client, event string, booking uplisting.Booking) error {
+	if event == bookingCancelled {
+		return nil
+	}
+
+	// A guest who's checked out early is as good as gone
+	now := time.Now()
+	if event == bookingCheckedOut && booking.DepartureAt().After(now) {
+		now = booking.DepartureAt()
+	}
+
+	report := newRunReport()
+	report.Tenant = config.Tenant
+	err := evaluateGuest(config, uplistingClient, textmagicClient, booking, now, report)
+	report.finish(err)
+	slog.Info("Evaluated guest", "booking", booking.ID, "sent", report.SentByTemplate, "skipped", report.SkipsByReason, "errors", report.ErrorsByCategory)
+	return err
+}
+
+// uplistingWebhook takes Uplisting's booking webhooks for one tenant.
+type uplistingWebhook struct {
+	config    config
+	uplisting *uplisting.Client
+	textmagic *textmagic.Client
+}
+
+func (h uplistingWebhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookSize))
+	if err != nil {
+		http.Error(w, "couldn't read body", http.StatusBadRequest)
+		return
+	}
+	if !h.config.verifyUplistingWebhook(r, body) {
+		slog.Warn("Uplisting webhook with a bad signature", "tenant", h.config.Tenant, "remote", r.RemoteAddr)
+		webhooksTotal.inc("uplisting", "unverified")
+		http.Error(w, "bad signature", http.StatusUnauthorized)
+		return
+	}
+	event, booking, err := decodeUplistingWebhook(body)
+	if err != nil {
+		slog.Warn("Couldn't decode Uplisting webhook:", "cause", err)
+		webhooksTotal.inc("uplisting", "invalid")
+		http.Error(w, "couldn't decode booking: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := recordWebhookBooking(h.config, event, booking); err != nil {
+		slog.Error("Couldn't record booking "+strconv.Itoa(booking.ID)+":", "cause", err)
+		http.Error(w, "couldn't record booking", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+
+	// Uplisting needn't wait while we talk to TextMagic
+	webhookActions.Add(1)
+	go func() {
+		defer webhookActions.Done()
+		// A panic here would take every tenant's daemon down with it
+		defer func() {
+			if r := recover(); r != nil {
+				slog.Error("Panic acting on booking "+strconv.Itoa(booking.ID)+":", "tenant", h.config.Tenant, "cause", r)
+				errorsTotal.inc("webhook")
+			}
+		}()
+		if err := actOnBooking(h.config, h.uplisting, h.textmagic, event, booking); err != nil {
+			slog.Error("Couldn't act on booking "+strconv.Itoa(booking.ID)+":", "cause", err)
+		}
+	}()
+}
+
+// webhookPath is where a tenant's webhooks go.
+func webhookPath(source, tenant string) string {
+	if tenant == "" {
+		return "/webhooks/" + source
+	}
+	return "/webhooks/" + source + "/" + tenant
+}
+
+// handleWebhooks adds the webhook endpoints for each tenant that takes them.
+func handleWebhooks(mux *http.ServeMux, tenants []config) {
+	for _, tenant := range tenants {
+		uplistingClient, textmagicClient := tenant.clients()
+		if tenant.UplistingWebhookSecret != "" {
+			path := webhookPath("uplisting", tenant.Tenant)
+			mux.Handle(path, uplistingWebhook{tenant, uplistingClient, textmagicClient})
+			slog.Info("Taking Uplisting webhooks", "path", path)
+		}
+		if tenant.TextMagicWebhookSecret != "" {
+			path := webhookPath("textmagic", tenant.Tenant)
+			mux.Handle(path, textmagicWebhook{tenant, textmagicClient})
+			slog.Info("Taking TextMagic callbacks", "path", path)
+		}
+	}
+}
+
+// uplistingWebhookCommand acts on recorded webhooks, one per file, as if
+// Uplisting had just sent them, but without checking any signature. It uses
+// the real APIs and state file, so it can text the guest.
+func uplistingWebhookCommand(config config, uplistingClient *uplisting.Client, textmagicClient *textmagic.Client, files []string) error {
+	if len(files) == 0 {
+		return errors.New("expected one or more files of webhook JSON")
+	}
+	for _, file := range files {
+		body, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		event, booking, err := decodeUplistingWebhook(body)
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		if err := recordWebhookBooking(config, event, booking); err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		if err := actOnBooking(config, uplistingClient, textmagicClient, event, booking); err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+	}
+	return nil
+}
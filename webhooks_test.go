@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/matthewbloch/text-guests/textmagic"
+	"github.com/matthewbloch/text-guests/uplisting"
+)
+
+const testWebhookSecret = "s3cret"
+
+func checkedOutWebhook(t *testing.T) []byte {
+	t.Helper()
+	body, err := os.ReadFile("testdata/uplisting-webhook-checked-out.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func sign(secret string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+func TestDecodeUplistingWebhook(t *testing.T) {
+	event, booking, err := decodeUplistingWebhook(checkedOutWebhook(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event != bookingCheckedOut {
+		t.Errorf("event = %q, want %q", event, bookingCheckedOut)
+	}
+	if booking.ID != 2693371 || booking.PropertyName != "Agar Street" || booking.CheckOut != "2023-11-04" {
+		t.Errorf("decoded %+v", booking)
+	}
+	if booking.GuestPhone != normalizePhone("+44 7700 900123") || booking.GuestPhone == "+44 7700 900123" {
+		t.Errorf("phone %q wasn't normalized", booking.GuestPhone)
+	}
+
+	tests := []struct {
+		name, body, event string
+		status            uplisting.BookingStatus
+		fails             bool
+	}{
+		{name: "type and data", body: `{"type":"Booking Created","data":{"id":1}}`, event: bookingCreated},
+		{name: "bare booking", body: `{"id":1,"status":"needs_check_in"}`, event: bookingUpdated, status: uplisting.StatusNeedsCheckIn},
+		{name: "cancelled status", body: `{"event":"booking.updated","booking":{"id":1,"status":"cancelled"}}`, event: bookingCancelled, status: uplisting.StatusCancelled},
+		{name: "cancel event", body: `{"event":"booking.canceled","booking":{"id":1}}`, event: bookingCancelled, status: uplisting.StatusCancelled},
+		{name: "no ID", body: `{"event":"booking.created","booking":{"guest_name":"Doris"}}`, fails: true},
+		{name: "not JSON", body: `event=created`, fails: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			event, booking, err := decodeUplistingWebhook([]byte(test.body))
+			if test.fails {
+				if err == nil {
+					t.Errorf("decoded %q as %s %+v", test.body, event, booking)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if event != test.event || booking.Status != test.status {
+				t.Errorf("got %s %q, want %s %q", event, booking.Status, test.event, test.status)
+			}
+		})
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	body := checkedOutWebhook(t)
+	mac := sign(testWebhookSecret, body)
+	tests := []struct {
+		name, signature string
+		ok              bool
+	}{
+		{"hex", hex.EncodeToString(mac), true},
+		{"hex with prefix", "sha256=" + hex.EncodeToString(mac), true},
+		{"base64", base64.StdEncoding.EncodeToString(mac), true},
+		{"base64 with prefix", " sha256=" + base64.StdEncoding.EncodeToString(mac) + " ", true},
+		{"wrong secret", hex.EncodeToString(sign("guess", body)), false},
+		{"other body", hex.EncodeToString(sign(testWebhookSecret, []byte("{}"))), false},
+		{"truncated", hex.EncodeToString(mac)[:32], false},
+		{"not encoded", "letmein", false},
+		{"empty", "", false},
+	}
+	for _, test := range tests {
+		if ok := verifySignature(testWebhookSecret, body, test.signature); ok != test.ok {
+			t.Errorf("%s: verifySignature = %v, want %v", test.name, ok, test.ok)
+		}
+	}
+}
+
+func TestVerifyUplistingWebhook(t *testing.T) {
+	body := checkedOutWebhook(t)
+	c := defaultConfig()
+	c.UplistingWebhookSecret = testWebhookSecret
+
+	tests := []struct {
+		name, query, signature string
+		ok                     bool
+	}{
+		{name: "signed", signature: hex.EncodeToString(sign(testWebhookSecret, body)), ok: true},
+		{name: "badly signed", signature: hex.EncodeToString(sign("guess", body))},
+		{name: "token", query: "?token=" + testWebhookSecret, ok: true},
+		{name: "wrong token", query: "?token=guess"},
+		{name: "neither"},
+		// A signature has to be right, whatever the token says
+		{name: "badly signed with token", query: "?token=" + testWebhookSecret, signature: "00"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", "/webhooks/uplisting"+test.query, nil)
+		if test.signature != "" {
+			r.Header.Set(c.UplistingWebhookSignatureHeader, test.signature)
+		}
+		if ok := c.verifyUplistingWebhook(r, body); ok != test.ok {
+			t.Errorf("%s: verifyUplistingWebhook = %v, want %v", test.name, ok, test.ok)
+		}
+	}
+
+	c.UplistingWebhookSecret = ""
+	r := httptest.NewRequest("POST", "/webhooks/uplisting?token=", nil)
+	if c.verifyUplistingWebhook(r, body) {
+		t.Error("verified a webhook without a secret")
+	}
+}
+
+// fakeAPIs stands in for both TextMagic and Uplisting, for a tenant with no
+// contacts yet, and keeps every message it's asked to send.
+type fakeAPIs struct {
+	t        *testing.T
+	mu       sync.Mutex
+	messages []textmagic.Message
+}
+
+func (f *fakeAPIs) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method + " " + r.URL.Path {
+	case "GET /api/v2/ping":
+		w.Write([]byte(`{"id":81512,"ping":"pong","utcDateTime":"2023-11-04T12:00:00+0000"}`))
+	case "GET /api/v2/customfields":
+		w.Write([]byte(`{"page":1,"pageCount":1,"limit":100,"resources":[{"id":1,"name":"Rebook state"}]}`))
+	case "GET /api/v2/lists":
+		w.Write([]byte(`{"page":1,"pageCount":1,"limit":100,"resources":[{"id":7,"name":"Guests"}]}`))
+	case "GET /api/v2/contacts/phone/" + normalizePhone("+44 7700 900123"):
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"code":404,"message":"Contact not found"}`))
+	case "POST /api/v2/contacts/normalized":
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id":42,"href":"/api/v2/contacts/42"}`))
+	case "PUT /api/v2/contacts/42", "PUT /api/v2/customfields/1/update":
+		w.Write([]byte(`{"id":42,"href":"/api/v2/contacts/42"}`))
+	case "POST /api/v2/messages":
+		var message textmagic.Message
+		if err := json.NewDecoder(r.Body).Decode(&message); err != nil {
+			f.t.Errorf("couldn't decode message: %v", err)
+		}
+		f.mu.Lock()
+		f.messages = append(f.messages, message)
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id":9001,"href":"/api/v2/schedules/9001","type":"schedule","scheduleId":9001}`))
+	case "GET /properties":
+		w.Write([]byte(`{"data":[{"id":"7458","type":"properties","attributes":{"name":"Agar Street","currency":"GBP"}}]}`))
+	default:
+		f.t.Errorf("unexpected %s %s", r.Method, r.URL)
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeAPIs) sent() []textmagic.Message {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]textmagic.Message(nil), f.messages...)
+}
+
+func TestUplistingWebhookServeHTTP(t *testing.T) {
+	fake := &fakeAPIs{t: t}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	c := validConfig()
+	c.UplistingApiBase = server.URL
+	c.TextMagicApiBase = server.URL
+	c.UplistingWebhookSecret = testWebhookSecret
+	c.StateFile = filepath.Join(t.TempDir(), "state.json")
+	c.UplistingRateLimit, c.TextMagicRateLimit = 1000, 1000
+	uplistingClient, textmagicClient := c.clients()
+	handler := uplistingWebhook{c, uplistingClient, textmagicClient}
+
+	body := checkedOutWebhook(t)
+	signed := hex.EncodeToString(sign(testWebhookSecret, body))
+	notJSON := []byte("event=checked_out")
+	tests := []struct {
+		name, method, signature string
+		body                    []byte
+		status                  int
+	}{
+		{"GET", "GET", signed, body, http.StatusMethodNotAllowed},
+		{"unsigned", "POST", "", body, http.StatusUnauthorized},
+		{"badly signed", "POST", hex.EncodeToString(sign("guess", body)), body, http.StatusUnauthorized},
+		{"not JSON", "POST", hex.EncodeToString(sign(testWebhookSecret, notJSON)), notJSON, http.StatusBadRequest},
+		{"checked out", "POST", signed, body, http.StatusAccepted},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, "/webhooks/uplisting", strings.NewReader(string(test.body)))
+		if test.signature != "" {
+			r.Header.Set(c.UplistingWebhookSignatureHeader, test.signature)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s: status %d, want %d: %s", test.name, w.Code, test.status, w.Body)
+		}
+	}
+	webhookActions.Wait()
+
+	store, err := openStore(c.StateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bookings := store.bookings(); len(bookings) != 1 || bookings[0].ID != 2693371 {
+		t.Errorf("stored bookings %+v, want just 2693371", bookings)
+	}
+	// Gone for more than 30 days, so they're due the OLD text
+	sent := fake.sent()
+	if len(sent) != 1 || sent[0].Contacts != "42" || !strings.HasPrefix(sent[0].Text, "Come back, Doris") {
+		t.Errorf("sent %+v, want OLD to contact 42", sent)
+	}
+}